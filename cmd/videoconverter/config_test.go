@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	return writeConfigFile(t, "config.json", content)
+}
+
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigKeepsLargeNumbers(t *testing.T) {
+	cfg, err := LoadConfig(writeConfig(t, `{"MERGE_BUFFER_SIZE": 2097152, "MIN_FREE_BYTES": 10000000000, "DISK_SPACE_MULTIPLIER": 2.5, "KEEP_FAILED_ARTIFACTS": true}`))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if got := cfg.Conversion.MergeBufferSize; got != 2097152 {
+		t.Errorf("MergeBufferSize = %d, want 2097152", got)
+	}
+	if got := cfg.Conversion.MinFreeBytes; got != 10000000000 {
+		t.Errorf("MinFreeBytes = %d, want 10000000000", got)
+	}
+	if got := cfg.Conversion.DiskSpaceMultiplier; got != 2.5 {
+		t.Errorf("DiskSpaceMultiplier = %g, want 2.5", got)
+	}
+	if !cfg.Conversion.KeepFailedArtifacts {
+		t.Error("KeepFailedArtifacts = false, want true")
+	}
+}
+
+func TestLoadConfigRejectsNestedValues(t *testing.T) {
+	for _, value := range []string{`{"size": 1}`, `[1, 2]`, `null`} {
+		_, err := LoadConfig(writeConfig(t, `{"MERGE_BUFFER_SIZE": `+value+`}`))
+		if err == nil || !strings.Contains(err.Error(), "MERGE_BUFFER_SIZE must be a string, number or boolean") {
+			t.Errorf("LoadConfig with %s: error = %v", value, err)
+		}
+	}
+}
+
+func TestLoadConfigReadsYAML(t *testing.T) {
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		path := writeConfigFile(t, name, "WORKERS: 4\nMIN_FREE_BYTES: 10000000000\nKEEP_FAILED_ARTIFACTS: true\nCHUNK_PATTERN: \"*.part\"\n")
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatalf("LoadConfig %s: %v", name, err)
+		}
+		if cfg.Workers != 4 {
+			t.Errorf("%s: Workers = %d, want 4", name, cfg.Workers)
+		}
+		if got := cfg.Conversion.MinFreeBytes; got != 10000000000 {
+			t.Errorf("%s: MinFreeBytes = %d, want 10000000000", name, got)
+		}
+		if !cfg.Conversion.KeepFailedArtifacts {
+			t.Errorf("%s: KeepFailedArtifacts = false, want true", name)
+		}
+		if got := cfg.Conversion.ChunkPattern; got != "*.part" {
+			t.Errorf("%s: ChunkPattern = %q, want *.part", name, got)
+		}
+	}
+}
+
+func TestLoadConfigRejectsNestedYAMLValues(t *testing.T) {
+	for _, value := range []string{"{size: 1}", "[1, 2]", "~"} {
+		_, err := LoadConfig(writeConfigFile(t, "config.yaml", "MERGE_BUFFER_SIZE: "+value+"\n"))
+		if err == nil || !strings.Contains(err.Error(), "MERGE_BUFFER_SIZE must be a string, number or boolean") {
+			t.Errorf("LoadConfig with %s: error = %v", value, err)
+		}
+	}
+}
+
+func TestLoadConfigRejectsNegativeMinFreeBytes(t *testing.T) {
+	_, err := LoadConfig(writeConfig(t, `{"MIN_FREE_BYTES": -1}`))
+	if err == nil || !strings.Contains(err.Error(), "MIN_FREE_BYTES: must not be negative") {
+		t.Errorf("LoadConfig error = %v, want a negative MIN_FREE_BYTES rejected", err)
+	}
+}
@@ -1,11 +1,58 @@
-CREATE TABLE processed_videos (
-    video_id INT PRIMARY KEY,          
-    status VARCHAR(50) NOT NULL,       
-    processed_at TIMESTAMP NOT NULL    
-);
-
-CREATE TABLE process_errors_log (
-    id SERIAL PRIMARY KEY,             
-    error_details JSONB NOT NULL,      
-    created_at TIMESTAMP NOT NULL      
-);
+-- video_id must stay the primary key: MarkProcessed relies on
+-- ON CONFLICT (video_id) to detect a video that another worker already
+-- finished. Workers also serialize on pg_try_advisory_lock(video_id).
+CREATE TABLE IF NOT EXISTS processed_videos (
+    video_id INT PRIMARY KEY,          
+    status VARCHAR(50) NOT NULL,       -- queued, processing, done or failed
+    processed_at TIMESTAMP,            
+    updated_at TIMESTAMP NOT NULL      
+);
+
+CREATE TABLE IF NOT EXISTS conversion_results (
+    video_id INT PRIMARY KEY,
+    duration_seconds DOUBLE PRECISION NOT NULL,
+    width INT NOT NULL,
+    height INT NOT NULL,
+    video_codec VARCHAR(50) NOT NULL,
+    segments INT NOT NULL,
+    output_bytes BIGINT NOT NULL,
+    task JSONB,                        -- original task, used to reprocess the video
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS process_errors_log (
+    id SERIAL PRIMARY KEY,             
+    error_details JSONB NOT NULL,      
+    created_at TIMESTAMP NOT NULL      
+);
+
+CREATE TABLE IF NOT EXISTS outbox (
+    id SERIAL PRIMARY KEY,
+    exchange VARCHAR(255) NOT NULL,
+    routing_key VARCHAR(255) NOT NULL,
+    queue VARCHAR(255) NOT NULL,
+    payload BYTEA NOT NULL,
+    content_type VARCHAR(255) NOT NULL DEFAULT 'application/json',
+    headers JSONB,
+    correlation_id VARCHAR(255),
+    created_at TIMESTAMP NOT NULL,
+    published_at TIMESTAMP
+);
+
+-- Upgrades a database created before the status state machine; every
+-- statement is a no-op on a fresh one. Rows marked 'success' by older
+-- workers are the videos that are now 'done', and rows created by SetStatus
+-- have no processed_at until they are done.
+ALTER TABLE processed_videos ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NOT NULL DEFAULT now();
+ALTER TABLE processed_videos ALTER COLUMN processed_at DROP NOT NULL;
+UPDATE processed_videos SET status = 'done', updated_at = now() WHERE status = 'success';
+
+-- Upgrades an outbox that only held JSON payloads, so a ConfirmationBuilder
+-- can store any payload along with its content type.
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS content_type VARCHAR(255) NOT NULL DEFAULT 'application/json';
+DO $$
+BEGIN
+    IF (SELECT data_type FROM information_schema.columns WHERE table_name = 'outbox' AND column_name = 'payload') = 'jsonb' THEN
+        ALTER TABLE outbox ALTER COLUMN payload TYPE BYTEA USING convert_to(payload::text, 'UTF8');
+    END IF;
+END $$;
@@ -0,0 +1,95 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var ErrEncoderUnavailable = errors.New("video encoder not available")
+
+type Accel string
+
+const (
+	AccelNone  Accel = "none"
+	AccelNVENC Accel = "nvenc"
+	AccelQSV   Accel = "qsv"
+	AccelVAAPI Accel = "vaapi"
+)
+
+// encoder returns the ffmpeg video encoder for a. Software encoding uses x264.
+func (a Accel) encoder() string {
+	switch a {
+	case AccelNVENC:
+		return "h264_nvenc"
+	case AccelQSV:
+		return "h264_qsv"
+	case AccelVAAPI:
+		return "h264_vaapi"
+	default:
+		return "libx264"
+	}
+}
+
+func (a Accel) inputArgs() []string {
+	switch a {
+	case AccelNVENC:
+		return []string{"-hwaccel", "cuda"}
+	case AccelQSV:
+		return []string{"-hwaccel", "qsv"}
+	case AccelVAAPI:
+		return []string{"-hwaccel", "vaapi", "-hwaccel_output_format", "vaapi"}
+	default:
+		return nil
+	}
+}
+
+func (a Accel) outputArgs() []string {
+	return []string{"-c:v", a.encoder()}
+}
+
+// checkFilters rejects the software filters that cannot process the frames
+// VAAPI keeps on the GPU: the rendition scaling and burned subtitles.
+func (a Accel) checkFilters(renditions []Rendition, subtitles SubtitleMode) error {
+	if a != AccelVAAPI {
+		return nil
+	}
+	if len(renditions) > 0 {
+		return fmt.Errorf("hardware acceleration %s does not support renditions, which are scaled in software", a)
+	}
+	if subtitles == SubtitleBurn {
+		return fmt.Errorf("hardware acceleration %s does not support subtitle mode %s, which renders in software", a, subtitles)
+	}
+	return nil
+}
+
+func listEncoders(ffmpegPath string) (string, error) {
+	output, err := exec.Command(ffmpegPath, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list ffmpeg encoders: %v", err)
+	}
+	return string(output), nil
+}
+
+// resolveAccel checks that ffmpeg was built with the encoder accel needs, so a
+// misconfigured GPU host fails at startup instead of on every task.
+func resolveAccel(ffmpegPath string, accel Accel) (Accel, error) {
+	switch accel {
+	case AccelNone, AccelNVENC, AccelQSV, AccelVAAPI:
+	default:
+		return "", fmt.Errorf("unsupported hardware acceleration %q: must be one of %s, %s, %s or %s", accel, AccelNone, AccelNVENC, AccelQSV, AccelVAAPI)
+	}
+
+	encoders, err := listEncoders(ffmpegPath)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(encoders, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == accel.encoder() {
+			return accel, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s (accel %s)", ErrEncoderUnavailable, accel.encoder(), accel)
+}
@@ -0,0 +1,64 @@
+package converter
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFFmpegArgsAccelWithRenditions(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{
+		Accel: AccelNVENC,
+		Renditions: []Rendition{
+			{Width: 1920, Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+			{Width: 1280, Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+		},
+	})
+	dir := t.TempDir()
+	args, err := vc.ffmpegArgs("merged.mp4", ffmpegOutput{dir: dir, format: FormatDASH, manifest: "output"})
+	if err != nil {
+		t.Fatalf("ffmpegArgs: %v", err)
+	}
+	want := []string{
+		"-y",
+		"-hwaccel", "cuda",
+		"-i", "merged.mp4",
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-s:v:0", "1920x1080", "-b:v:0", "5000k",
+		"-s:v:1", "1280x720", "-b:v:1", "2800k",
+		"-c:v", "h264_nvenc",
+		"-c:a", "copy",
+		"-f", "dash",
+		"-seg_duration", "4",
+		"-adaptation_sets", "id=0,streams=v id=1,streams=a",
+		filepath.Join(dir, dashDir, "output.mpd"),
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("ffmpegArgs =\n%q\nwant\n%q", args, want)
+	}
+}
+
+func TestVAAPIRejectsSoftwareFilters(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ConversionOptions
+	}{
+		{"renditions", ConversionOptions{Renditions: []Rendition{{Width: 1280, Height: 720, VideoBitrate: 2800, AudioBitrate: 128}}}},
+		{"burned subtitles", ConversionOptions{SubtitleMode: SubtitleBurn}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			options.Runner = &stubRunner{}
+			options.Accel = AccelVAAPI
+			if _, err := NewVideoConverter(nil, nil, options); err == nil {
+				t.Error("NewVideoConverter accepted a software filter on VAAPI frames")
+			}
+			options.Accel = AccelNVENC
+			if _, err := NewVideoConverter(nil, nil, options); err != nil {
+				t.Errorf("NewVideoConverter with %s: %v", AccelNVENC, err)
+			}
+		})
+	}
+}
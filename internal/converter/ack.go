@@ -0,0 +1,87 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func ack(d amqp.Delivery, task VideoTask) {
+	if err := d.Ack(false); err != nil {
+		task.log().Error("Failed to ack delivery", slog.String("error", err.Error()))
+	}
+}
+
+func nack(d amqp.Delivery, task VideoTask, requeue bool) {
+	if err := d.Nack(false, requeue); err != nil {
+		task.log().Error("Failed to nack delivery", slog.Bool("requeue", requeue), slog.String("error", err.Error()))
+	}
+}
+
+// Reasons passed to Metrics.TaskRequeued.
+const (
+	requeueLocked  = "locked"
+	requeueLowDisk = "low_disk"
+)
+
+// requeueAfter holds the delivery for delay, or until ctx is done, before
+// requeueing it, so a task that cannot start yet is not redelivered in a
+// tight loop.
+func (vc *VideoConverter) requeueAfter(ctx context.Context, d amqp.Delivery, task VideoTask, delay time.Duration, reason string) {
+	select {
+	case <-time.After(delay):
+	case <-ctx.Done():
+	}
+	vc.options.Metrics.TaskRequeued(reason)
+	nack(d, task, true)
+}
+
+// settlement records whether the delivery it acknowledges was acked or
+// nacked, whatever copy of the delivery settled it.
+type settlement struct {
+	amqp.Acknowledger
+	settled atomic.Bool
+}
+
+// trackSettlement routes the settlement of d through the returned
+// settlement.
+func trackSettlement(d *amqp.Delivery) *settlement {
+	s := &settlement{Acknowledger: d.Acknowledger}
+	d.Acknowledger = s
+	return s
+}
+
+func (s *settlement) Ack(tag uint64, multiple bool) error {
+	s.settled.Store(true)
+	return s.Acknowledger.Ack(tag, multiple)
+}
+
+func (s *settlement) Nack(tag uint64, multiple, requeue bool) error {
+	s.settled.Store(true)
+	return s.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (s *settlement) Reject(tag uint64, requeue bool) error {
+	s.settled.Store(true)
+	return s.Acknowledger.Reject(tag, requeue)
+}
+
+// recoverDelivery dead-letters a delivery whose handler panicked, so it is not
+// left unacknowledged until the channel closes and can be inspected and
+// replayed, recording it as failed in StagePanic. A delivery the handler
+// already settled is left alone: settling it twice closes the channel, and
+// its outcome was already recorded.
+func (vc *VideoConverter) recoverDelivery(d amqp.Delivery, task *VideoTask, s *settlement, dlq deadLetterTarget) {
+	if r := recover(); r != nil {
+		err := fmt.Errorf("panic: %v", r)
+		vc.logError(*task, "Panic while handling task", err)
+		if !s.settled.Load() {
+			vc.options.Metrics.TaskFailed(StagePanic)
+			vc.deadLetter(d, *task, dlq, err)
+		}
+	}
+}
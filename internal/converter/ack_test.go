@@ -0,0 +1,226 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestHandleSettlesEveryDelivery(t *testing.T) {
+	failFFmpeg := func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name == defaultFFprobePath {
+			return []byte(ffprobeJSON), nil
+		}
+		return []byte("Conversion failed!"), errors.New("exit status 1")
+	}
+	tests := []struct {
+		name    string
+		body    []byte
+		options ConversionOptions
+		// cancel cancels the task from within ffmpeg.
+		cancel  bool
+		want    string
+		publish string
+	}{
+		{name: "success", want: "ack"},
+		{name: "malformed json", body: []byte(`{"video_id":`), want: "ack", publish: "dead-letter"},
+		{name: "process failure", options: ConversionOptions{Runner: &stubRunner{run: failFFmpeg}}, want: "ack", publish: "conversion"},
+		{name: "cancelled", cancel: true, want: "requeue"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				tt.options.Runner = &stubRunner{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+					if name == defaultFFprobePath {
+						return []byte(ffprobeJSON), nil
+					}
+					cancel()
+					return nil, ctx.Err()
+				}}
+			}
+			tt.options.RetryBackoff = time.Millisecond
+			vc, _ := newTestConverter(t, tt.options)
+			dir := t.TempDir()
+			writeChunks(t, dir, "chunk_0.chunk")
+			d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+			if tt.body != nil {
+				d.Body = tt.body
+			}
+
+			handle(ctx, vc, d)
+
+			if outcome := ack.outcome(); outcome != tt.want {
+				t.Errorf("delivery was %s, want %s", outcome, tt.want)
+			}
+			published := vc.rabbitmqClient.(*fakeBroker).messages()
+			switch {
+			case tt.publish == "" && len(published) > 0:
+				t.Errorf("published %+v, want nothing", published)
+			case tt.publish != "" && (len(published) != 1 || published[0].exchange != tt.publish):
+				t.Errorf("published %+v, want one message to %s", published, tt.publish)
+			}
+		})
+	}
+}
+
+func TestHandleDiscardsMalformedTaskWithoutDeadLetterExchange(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{})
+	d, ack := newDelivery(t, VideoTask{})
+	d.Body = []byte("not json")
+
+	vc.Handle(context.Background(), d, Routing{
+		ConversionExchange: testRouting.ConversionExchange,
+		ConfirmationKey:    testRouting.ConfirmationKey,
+		ConfirmationQueue:  testRouting.ConfirmationQueue,
+	})
+
+	if outcome := ack.outcome(); outcome != "discard" {
+		t.Errorf("delivery was %s, want discard", outcome)
+	}
+}
+
+func TestHandleDeadLettersWhenRetriesAreExhausted(t *testing.T) {
+	runner := &stubRunner{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name == defaultFFprobePath {
+			return []byte(ffprobeJSON), nil
+		}
+		return nil, errors.New("exit status 1")
+	}}
+	vc, _ := newTestConverter(t, ConversionOptions{Runner: runner, MaxRetries: 2})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	d.Headers = amqp.Table{retryCountHeader: int32(2)}
+
+	handle(context.Background(), vc, d)
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Errorf("delivery was %s, want ack", outcome)
+	}
+	if published := vc.rabbitmqClient.(*fakeBroker).messages(); len(published) != 1 || published[0].exchange != "dead-letter" {
+		t.Errorf("published %+v, want the task dead-lettered", published)
+	}
+}
+
+func TestHandleDelaysRetryThroughBroker(t *testing.T) {
+	runner := &stubRunner{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name == defaultFFprobePath {
+			return []byte(ffprobeJSON), nil
+		}
+		return nil, errors.New("exit status 1")
+	}}
+	vc, _ := newTestConverter(t, ConversionOptions{Runner: runner, RetryBackoff: time.Hour})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	d.Headers = amqp.Table{retryCountHeader: int32(1)}
+
+	done := make(chan struct{})
+	go func() {
+		handle(context.Background(), vc, d)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle held the delivery for the retry backoff")
+	}
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Errorf("delivery was %s, want ack", outcome)
+	}
+	published := vc.rabbitmqClient.(*fakeBroker).messages()
+	if len(published) != 1 {
+		t.Fatalf("published %+v, want the retry", published)
+	}
+	retry := published[0]
+	if retry.exchange != "conversion" || retry.routingKey != "convert" || retry.delay != 2*time.Hour {
+		t.Errorf("retry published to %s/%s after %s, want conversion/convert after 2h", retry.exchange, retry.routingKey, retry.delay)
+	}
+	if count := retry.msg.Headers[retryCountHeader]; count != int32(2) {
+		t.Errorf("retry count = %v, want 2", count)
+	}
+}
+
+func TestRecoverDeliveryOnlySettlesOnce(t *testing.T) {
+	tests := []struct {
+		name  string
+		hooks Hooks
+		want  string
+		// deadLettered reports whether the task reached the dead-letter
+		// exchange.
+		deadLettered bool
+		// succeeded and failed are the outcomes recorded in Metrics.
+		succeeded int
+		failed    []Stage
+	}{
+		{
+			name:         "panic before settling",
+			hooks:        Hooks{BeforeProcess: func(VideoTask) { panic("boom") }},
+			want:         "ack",
+			deadLettered: true,
+			failed:       []Stage{StagePanic},
+		},
+		{
+			name:      "panic after settling",
+			hooks:     Hooks{AfterPublish: func(VideoTask, ConfirmationMessage) { panic("boom") }},
+			want:      "ack",
+			succeeded: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := &recordingMetrics{}
+			vc, _ := newTestConverter(t, ConversionOptions{Hooks: tt.hooks, Metrics: metrics})
+			dir := t.TempDir()
+			writeChunks(t, dir, "chunk_0.chunk")
+			d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+
+			handle(context.Background(), vc, d)
+
+			if outcome := ack.outcome(); outcome != tt.want {
+				t.Errorf("delivery was %s, want %s", outcome, tt.want)
+			}
+			deadLettered := slices.ContainsFunc(vc.rabbitmqClient.(*fakeBroker).messages(), func(p fakePublishing) bool {
+				return p.exchange == "dead-letter"
+			})
+			if deadLettered != tt.deadLettered {
+				t.Errorf("dead-lettered = %t, want %t", deadLettered, tt.deadLettered)
+			}
+			if metrics.succeeded != tt.succeeded || !reflect.DeepEqual(metrics.failed, tt.failed) {
+				t.Errorf("recorded %d succeeded and failed %v, want %d and %v", metrics.succeeded, metrics.failed, tt.succeeded, tt.failed)
+			}
+		})
+	}
+}
+
+func TestHandleRequeuesWhenLowOnDisk(t *testing.T) {
+	metrics := &recordingMetrics{}
+	vc, _ := newTestConverter(t, ConversionOptions{MinFreeBytes: math.MaxUint64, Metrics: metrics})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	// Cuts the backpressure delay short.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	handle(ctx, vc, d)
+
+	if outcome := ack.outcome(); outcome != "requeue" {
+		t.Errorf("delivery was %s, want requeue", outcome)
+	}
+	if requeues := metrics.requeues(); !reflect.DeepEqual(requeues, []string{requeueLowDisk}) {
+		t.Errorf("requeues = %q, want [%s]", requeues, requeueLowDisk)
+	}
+	if calls := vc.options.Runner.(*stubRunner).calls; len(calls) != 0 {
+		t.Errorf("commands ran while low on disk: %q", calls)
+	}
+}
@@ -0,0 +1,36 @@
+package converter
+
+import "fmt"
+
+// AudioMode selects what happens to the audio track.
+type AudioMode string
+
+const (
+	// AudioCopy keeps the audio track as uploaded.
+	AudioCopy AudioMode = "copy"
+	// AudioAAC re-encodes the audio track to AAC, using the rendition audio
+	// bitrates when set.
+	AudioAAC AudioMode = "aac"
+	// AudioNone drops every audio track.
+	AudioNone AudioMode = "none"
+)
+
+func (m AudioMode) validate() error {
+	switch m {
+	case AudioCopy, AudioAAC, AudioNone:
+		return nil
+	default:
+		return fmt.Errorf("unsupported audio mode %q: must be one of %s, %s or %s", m, AudioCopy, AudioAAC, AudioNone)
+	}
+}
+
+func (m AudioMode) outputArgs() []string {
+	switch m {
+	case AudioAAC:
+		return []string{"-c:a", "aac"}
+	case AudioNone:
+		return []string{"-an"}
+	default:
+		return []string{"-c:a", "copy"}
+	}
+}
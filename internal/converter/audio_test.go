@@ -0,0 +1,56 @@
+package converter
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAudioModeReachesFFmpeg(t *testing.T) {
+	tests := []struct {
+		mode    AudioMode
+		want    []string
+		notWant []string
+	}{
+		{mode: AudioCopy, want: []string{"-map 0:a:0?", "-c:a copy"}, notWant: []string{"-b:a:0", "-an"}},
+		{mode: AudioAAC, want: []string{"-map 0:a:0?", "-b:a:0 192k", "-b:a:1 128k", "-c:a aac"}, notWant: []string{"-an"}},
+		{mode: AudioNone, want: []string{"-an"}, notWant: []string{"0:a:0?", "-c:a", "-b:a:0"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			runner := &stubRunner{}
+			vc, _ := newTestConverter(t, ConversionOptions{
+				Runner:    runner,
+				AudioMode: tt.mode,
+				Renditions: []Rendition{
+					{Width: 1920, Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+					{Width: 1280, Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+				},
+			})
+			dir := t.TempDir()
+			writeChunks(t, dir, "chunk_0.chunk")
+
+			if _, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir}); err != nil {
+				t.Fatalf("processVideo: %v", err)
+			}
+			calls := runner.ffmpegCalls()
+			if len(calls) != 1 {
+				t.Fatalf("ffmpeg calls = %q, want the conversion only", calls)
+			}
+			// Pairs are matched as "flag value" with a trailing space so
+			// that -b:a:1 does not match -b:a:10.
+			args := strings.Join(calls[0], " ") + " "
+			for _, want := range tt.want {
+				if !strings.Contains(args, want+" ") {
+					t.Errorf("ffmpeg args lack %q: %s", want, args)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if slices.ContainsFunc(calls[0], func(arg string) bool { return strings.Contains(arg, notWant) }) {
+					t.Errorf("ffmpeg args contain %q: %s", notWant, args)
+				}
+			}
+		})
+	}
+}
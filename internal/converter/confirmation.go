@@ -0,0 +1,104 @@
+package converter
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ConfirmationBuilder builds the confirmation payload published once a video
+// is converted, along with its content type. The payload is published as is,
+// so it does not have to be JSON.
+type ConfirmationBuilder func(task VideoTask, result Result) (payload []byte, contentType string, err error)
+
+// ConfirmationMessage is published once a video is converted. Manifests,
+// Thumbnail, Subtitles, Sprites, SpriteVTT and Metadata are relative to Path.
+type ConfirmationMessage struct {
+	VideoID     int            `json:"video_id"`
+	Path        string         `json:"path"`
+	Format      OutputFormat   `json:"format"`
+	Formats     []OutputFormat `json:"formats"`
+	Manifests   []string       `json:"manifests"`
+	OutputBytes int64          `json:"output_bytes"`
+	Segments    int            `json:"segments"`
+	Renditions  []Rendition    `json:"renditions"`
+	Thumbnail   string         `json:"thumbnail"`
+	Subtitles   string         `json:"subtitles,omitempty"`
+	Sprites     []string       `json:"sprites"`
+	SpriteVTT   string         `json:"sprite_vtt"`
+	Metadata    string         `json:"metadata"`
+	Media       *MediaInfo     `json:"media"`
+}
+
+func (vc *VideoConverter) confirmation(task VideoTask, result *Result) ConfirmationMessage {
+	format := result.Format
+	if format == "" {
+		format = vc.outputFormat(task)
+	}
+	formats, _ := format.formats()
+	manifests := result.Manifests
+	if manifests == nil {
+		manifests = manifestPaths(formats, vc.manifestName(task))
+	}
+	location := vc.outputPath(&task)
+	if result.Location != "" {
+		location = result.Location
+	}
+	renditions := vc.options.Renditions
+	if renditions == nil {
+		renditions = []Rendition{}
+	}
+	sprites := result.Sprites
+	if sprites == nil {
+		sprites = []string{}
+	}
+	return ConfirmationMessage{
+		VideoID:     task.VideoID,
+		Path:        location,
+		Format:      format,
+		Formats:     formats,
+		Manifests:   manifests,
+		OutputBytes: result.OutputBytes,
+		Segments:    result.Segments,
+		Renditions:  renditions,
+		Thumbnail:   result.Thumbnail,
+		Subtitles:   result.Subtitles,
+		Sprites:     sprites,
+		SpriteVTT:   result.SpriteVTT,
+		Metadata:    result.Metadata,
+		Media:       result.Media,
+	}
+}
+
+// confirmationPayload builds the payload and its content type with
+// ConversionOptions.ConfirmationBuilder, or encodes confirmation as JSON when
+// none is set.
+func (vc *VideoConverter) confirmationPayload(task VideoTask, result *Result, confirmation ConfirmationMessage) ([]byte, string, error) {
+	if vc.options.ConfirmationBuilder != nil {
+		return vc.options.ConfirmationBuilder(task, *result)
+	}
+	payload, err := json.Marshal(confirmation)
+	return payload, jsonContentType, err
+}
+
+// manifestName is ManifestName for the task, without its extension.
+func (vc *VideoConverter) manifestName(task VideoTask) string {
+	name := strings.ReplaceAll(vc.options.ManifestName, "{video_id}", strconv.Itoa(task.VideoID))
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+func manifestPaths(formats []OutputFormat, name string) []string {
+	manifests := make([]string, 0, len(formats))
+	for _, f := range formats {
+		manifests = append(manifests, manifestPath(f, name))
+	}
+	return manifests
+}
+
+func manifestPath(format OutputFormat, name string) string {
+	if format == FormatHLS {
+		return path.Join(hlsDir, name+hlsExt)
+	}
+	return path.Join(dashDir, name+dashExt)
+}
@@ -0,0 +1,35 @@
+package converter
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestConfirmationMessageRoundTrip(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{})
+	task := VideoTask{VideoID: 7, Path: `/uploads/"quoted" back\slash/vídeo ✓ 日本`}
+	result := &Result{
+		Thumbnail: `a "thumb"\.jpg`,
+		Sprites:   []string{"sprites/ß .png"},
+	}
+
+	want := vc.confirmation(task, result)
+	payload, contentType, err := vc.confirmationPayload(task, result, want)
+	if err != nil {
+		t.Fatalf("confirmationPayload: %v", err)
+	}
+	if contentType != "application/json" {
+		t.Errorf("content type = %q, want application/json", contentType)
+	}
+	var got ConfirmationMessage
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatalf("payload is not valid JSON: %v\n%s", err, payload)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded confirmation =\n%+v\nwant\n%+v", got, want)
+	}
+	if got.Path != task.Path {
+		t.Errorf("Path = %q, want %q", got.Path, task.Path)
+	}
+}
@@ -0,0 +1,52 @@
+package converter
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNoResult is returned for a Converter that succeeded without a Result.
+var ErrNoResult = errors.New("converter returned no result")
+
+// Converter turns a task into its converted output. The default
+// implementation merges the chunks and runs ffmpeg locally. A nil error must
+// come with a Result.
+type Converter interface {
+	Convert(ctx context.Context, task *VideoTask) (*Result, error)
+}
+
+// Result describes the output of a conversion. Manifests and the other files
+// are relative to Location, and the confirmation falls back to the task output
+// path and format for the fields a Converter leaves empty.
+type Result struct {
+	Media *MediaInfo
+	// Location is where the output was stored: the output path, or the
+	// object storage location when it was uploaded.
+	Location string
+	Format   OutputFormat
+	// Manifests has one manifest per format.
+	Manifests []string
+	Thumbnail string
+	Subtitles string
+	Sprites   []string
+	SpriteVTT string
+	Metadata  string
+
+	Segments    int
+	OutputBytes int64
+
+	// chunks are the merged chunks, removed with RemoveChunksAfterMerge.
+	chunks []string
+}
+
+type ffmpegConverter struct {
+	vc *VideoConverter
+}
+
+func (c ffmpegConverter) Convert(ctx context.Context, task *VideoTask) (*Result, error) {
+	result, err := c.vc.processVideo(ctx, task)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
@@ -0,0 +1,285 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ffprobeJSON is what the stub ffprobe prints: a 10s 1080p video with audio.
+const ffprobeJSON = `{"format":{"duration":"10.0","bit_rate":"5000000"},"streams":[` +
+	`{"codec_type":"video","codec_name":"h264","width":1920,"height":1080},` +
+	`{"codec_type":"audio","codec_name":"aac"}]}`
+
+// stubRunner records every command instead of running it. run, when set,
+// decides the outcome of each command; otherwise ffprobe prints ffprobeJSON
+// and every other command succeeds. A streamed command writes its output to
+// stderr and stdout to stdout.
+type stubRunner struct {
+	mu     sync.Mutex
+	calls  [][]string
+	run    func(ctx context.Context, name string, args ...string) ([]byte, error)
+	stdout string
+}
+
+func (r *stubRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, append([]string{name}, args...))
+	r.mu.Unlock()
+	if r.run != nil {
+		return r.run(ctx, name, args...)
+	}
+	if name == defaultFFprobePath {
+		return []byte(ffprobeJSON), nil
+	}
+	return nil, nil
+}
+
+func (r *stubRunner) Stream(ctx context.Context, stdout, stderr io.Writer, name string, args ...string) error {
+	output, err := r.Run(ctx, name, args...)
+	stderr.Write(output)
+	io.WriteString(stdout, r.stdout)
+	return err
+}
+
+// ffmpegCalls returns the arguments of every ffmpeg command.
+func (r *stubRunner) ffmpegCalls() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var calls [][]string
+	for _, call := range r.calls {
+		if call[0] == defaultFFmpegPath {
+			calls = append(calls, call[1:])
+		}
+	}
+	return calls
+}
+
+type fakePublishing struct {
+	exchange   string
+	routingKey string
+	queue      string
+	delay      time.Duration
+	msg        amqp.Publishing
+}
+
+// fakeBroker records what is published, failing every publish with err when
+// it is set. onPublish, when set, is called before each publish.
+type fakeBroker struct {
+	mu        sync.Mutex
+	published []fakePublishing
+	err       error
+	onPublish func()
+}
+
+func (b *fakeBroker) record(exchange, routingKey, queue string, msg amqp.Publishing) error {
+	return b.recordDelayed(exchange, routingKey, queue, 0, msg)
+}
+
+func (b *fakeBroker) recordDelayed(exchange, routingKey, queue string, delay time.Duration, msg amqp.Publishing) error {
+	if b.onPublish != nil {
+		b.onPublish()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.published = append(b.published, fakePublishing{exchange: exchange, routingKey: routingKey, queue: queue, delay: delay, msg: msg})
+	return nil
+}
+
+func (b *fakeBroker) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *fakeBroker) messages() []fakePublishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]fakePublishing(nil), b.published...)
+}
+
+func (b *fakeBroker) ConsumeMessages(string, string, string) (<-chan amqp.Delivery, error) {
+	return nil, nil
+}
+
+func (b *fakeBroker) SetPrefetch(int) {}
+
+func (b *fakeBroker) Publish(exchange, routingKey string, msg amqp.Publishing) error {
+	return b.record(exchange, routingKey, "", msg)
+}
+
+func (b *fakeBroker) PublishDelayed(exchange, routingKey string, delay time.Duration, msg amqp.Publishing) error {
+	return b.recordDelayed(exchange, routingKey, "", delay, msg)
+}
+
+func (b *fakeBroker) PublishMessage(exchange, routingKey, queue string, message []byte) error {
+	return b.record(exchange, routingKey, queue, amqp.Publishing{ContentType: "application/json", Body: message})
+}
+
+func (b *fakeBroker) PublishToQueue(exchange, routingKey, queue string, msg amqp.Publishing) error {
+	return b.record(exchange, routingKey, queue, msg)
+}
+
+func (b *fakeBroker) StopConsuming() error {
+	return nil
+}
+
+func (b *fakeBroker) Close() error {
+	return nil
+}
+
+// fakeAcknowledger records how a delivery was settled.
+type fakeAcknowledger struct {
+	mu       sync.Mutex
+	acks     int
+	nacks    int
+	requeued int
+}
+
+func (a *fakeAcknowledger) Ack(uint64, bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acks++
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nacks++
+	if requeue {
+		a.requeued++
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// outcome describes how the delivery was settled: ack, requeue or discard,
+// or "unsettled". Settling more than once is reported as such.
+func (a *fakeAcknowledger) outcome() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	switch {
+	case a.acks+a.nacks > 1:
+		return "settled more than once"
+	case a.acks == 1:
+		return "ack"
+	case a.requeued == 1:
+		return "requeue"
+	case a.nacks == 1:
+		return "discard"
+	}
+	return "unsettled"
+}
+
+// newDelivery returns a delivery carrying task, settled through the returned
+// fakeAcknowledger.
+func newDelivery(t *testing.T, task VideoTask) (amqp.Delivery, *fakeAcknowledger) {
+	t.Helper()
+	body, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := &fakeAcknowledger{}
+	return amqp.Delivery{Acknowledger: ack, Body: body, Exchange: "conversion", RoutingKey: "convert"}, ack
+}
+
+// testRouting is the routing handle passes to Handle.
+var testRouting = Routing{
+	ConversionExchange: "conversion",
+	ConfirmationKey:    "confirmation",
+	ConfirmationQueue:  "confirmations",
+	DeadLetterExchange: "dead-letter",
+	DeadLetterKey:      "dead",
+	DeadLetterQueue:    "dead-letters",
+}
+
+// handle runs Handle with testRouting.
+func handle(ctx context.Context, vc *VideoConverter, d amqp.Delivery) {
+	vc.Handle(ctx, d, testRouting)
+}
+
+// recordingMetrics counts the outcomes of the tasks.
+type recordingMetrics struct {
+	noopMetrics
+	mu        sync.Mutex
+	succeeded int
+	failed    []Stage
+	requeued  []string
+}
+
+func (m *recordingMetrics) TaskSucceeded() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.succeeded++
+}
+
+func (m *recordingMetrics) TaskFailed(stage Stage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failed = append(m.failed, stage)
+}
+
+func (m *recordingMetrics) TaskRequeued(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requeued = append(m.requeued, reason)
+}
+
+func (m *recordingMetrics) requeues() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.requeued...)
+}
+
+// captureLogs sends the default logger to the returned buffer for the rest
+// of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+// newTestConverter returns a converter backed by a fakeDB and a fakeBroker,
+// whose commands go to a stubRunner unless options sets a Runner.
+func newTestConverter(t *testing.T, options ConversionOptions) (*VideoConverter, *fakeDB) {
+	t.Helper()
+	if options.Runner == nil {
+		options.Runner = &stubRunner{}
+	}
+	fake, db := newFakeDB(t)
+	vc, err := NewVideoConverter(nil, db, options)
+	if err != nil {
+		t.Fatalf("NewVideoConverter: %v", err)
+	}
+	vc.rabbitmqClient = &fakeBroker{}
+	return vc, fake
+}
+
+// writeChunks creates the named chunks in dir, each holding its own name.
+func writeChunks(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// backpressureDelay is how long a worker holds a delivery before requeueing
+// it while free space is below MinFreeBytes.
+const backpressureDelay = 5 * time.Second
+
+var ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+
+// outputVolume is a directory on the filesystem the task output is written to.
+func (vc *VideoConverter) outputVolume(task *VideoTask) string {
+	switch {
+	case !vc.localStorage():
+		return os.TempDir()
+	case vc.options.OutputBaseDir != "":
+		return vc.options.OutputBaseDir
+	default:
+		return task.Path
+	}
+}
+
+// lowOnDisk reports whether the output volume has less than MinFreeBytes
+// free. A volume that cannot be checked is assumed to have room.
+func (vc *VideoConverter) lowOnDisk(task *VideoTask) bool {
+	if vc.options.MinFreeBytes == 0 {
+		return false
+	}
+	dir := vc.outputVolume(task)
+	free, err := freeSpace(dir)
+	if err != nil {
+		task.log().Warn("Could not check free disk space", slog.String("path", dir), slog.String("error", err.Error()))
+		return false
+	}
+	if free < vc.options.MinFreeBytes {
+		task.log().Warn("Free disk space below minimum, applying backpressure", slog.String("path", dir),
+			slog.Uint64("free", free), slog.Uint64("min_free", vc.options.MinFreeBytes))
+		return true
+	}
+	return false
+}
+
+// checkDiskSpace estimates the space the task needs from the size of its
+// chunks and fails early when the filesystem of dir cannot hold it.
+func (vc *VideoConverter) checkDiskSpace(task *VideoTask, dir string) error {
+	files, err := vc.listChunks(task.Path)
+	if err != nil {
+		return fmt.Errorf("failed to find chunks: %v", err)
+	}
+	var size int64
+	for _, file := range files {
+		n, err := vc.options.Storage.Size(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat chunk %s: %v", file, err)
+		}
+		size += n
+	}
+	required := uint64(float64(size) * vc.options.DiskSpaceMultiplier)
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("failed to check free space in %s: %v", dir, err)
+	}
+	if free < required {
+		return fmt.Errorf("%w in %s: need %d bytes, %d free", ErrInsufficientDiskSpace, dir, required, free)
+	}
+	return nil
+}
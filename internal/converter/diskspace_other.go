@@ -0,0 +1,10 @@
+//go:build !unix
+
+package converter
+
+import "math"
+
+// freeSpace is not implemented on this platform, so the check always passes.
+func freeSpace(dir string) (uint64, error) {
+	return math.MaxUint64, nil
+}
@@ -0,0 +1,46 @@
+package converter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const hlsKeySize = 16
+
+// KeyProvider supplies the AES-128 key used to encrypt the HLS segments of a
+// video and the URI players fetch it from.
+type KeyProvider interface {
+	Key(videoID int) (key []byte, keyURI string, err error)
+}
+
+// writeKeyInfo writes the key and the key info file ffmpeg expects into a
+// private temporary directory, outside of the published output. The returned
+// function removes them.
+func (vc *VideoConverter) writeKeyInfo(videoID int) (string, func(), error) {
+	key, keyURI, err := vc.options.KeyProvider.Key(videoID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get encryption key: %v", err)
+	}
+	if len(key) != hlsKeySize {
+		return "", nil, fmt.Errorf("invalid encryption key: expected %d bytes, got %d", hlsKeySize, len(key))
+	}
+	dir, err := os.MkdirTemp("", fmt.Sprintf("video-%d-key-", videoID))
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+	keyFile := filepath.Join(dir, "enc.key")
+	if err := os.WriteFile(keyFile, key, 0o600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	keyInfoFile := filepath.Join(dir, "enc.keyinfo")
+	if err := os.WriteFile(keyInfoFile, []byte(keyURI+"\n"+keyFile+"\n"), 0o600); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return keyInfoFile, cleanup, nil
+}
@@ -0,0 +1,336 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is an in-memory stand-in for the Postgres tables the converter uses.
+// It understands the statements the package issues, advisory locks included,
+// and can delay or fail them.
+type fakeDB struct {
+	mu       sync.Mutex
+	statuses map[int]VideoStatus
+	locks    map[int]*fakeConn
+	outbox   []fakeOutboxRow
+	errors   [][]byte
+	results  map[int][]byte
+	// delay holds every statement back, or until its context is done.
+	delay time.Duration
+	// fail makes every statement containing the key fail with its error.
+	fail      map[string]error
+	commits   int
+	rollbacks int
+	nextConn  int
+}
+
+type fakeOutboxRow struct {
+	id            int64
+	message       OutboxMessage
+	headers       []byte
+	published     bool
+	correlationID string
+}
+
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	t.Helper()
+	f := &fakeDB{
+		statuses: map[int]VideoStatus{},
+		locks:    map[int]*fakeConn{},
+		results:  map[int][]byte{},
+		fail:     map[string]error{},
+	}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return f, db
+}
+
+func (f *fakeDB) status(videoID int) VideoStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statuses[videoID]
+}
+
+func (f *fakeDB) setStatus(videoID int, status VideoStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[videoID] = status
+}
+
+// locked reports whether a session holds the advisory lock of the video.
+func (f *fakeDB) locked(videoID int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, held := f.locks[videoID]
+	return held
+}
+
+func (f *fakeDB) transactions() (commits, rollbacks int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commits, f.rollbacks
+}
+
+func (f *fakeDB) failOn(statement string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[statement] = err
+}
+
+func (f *fakeDB) outboxRows() []fakeOutboxRow {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]fakeOutboxRow(nil), f.outbox...)
+}
+
+// loggedErrors returns the error_details stored by RegisterError, one per
+// line.
+func (f *fakeDB) loggedErrors() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return string(bytes.Join(f.errors, []byte("\n")))
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextConn++
+	return &fakeConn{db: f, id: f.nextConn}, nil
+}
+
+func (f *fakeDB) Driver() driver.Driver {
+	return fakeDriver{f}
+}
+
+type fakeDriver struct {
+	db *fakeDB
+}
+
+func (d fakeDriver) Open(string) (driver.Conn, error) {
+	return d.db.Connect(context.Background())
+}
+
+type fakeConn struct {
+	db *fakeDB
+	id int
+	// undo reverts the writes of the running transaction.
+	undo []func()
+	inTx bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakedb: prepared statements are not supported")
+}
+
+// Close ends the session, which releases its advisory locks.
+func (c *fakeConn) Close() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	for id, owner := range c.db.locks {
+		if owner == c {
+			delete(c.db.locks, id)
+		}
+	}
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(ctx context.Context, _ driver.TxOptions) (driver.Tx, error) {
+	if err := c.wait(ctx, "begin"); err != nil {
+		return nil, err
+	}
+	c.inTx = true
+	c.undo = nil
+	return fakeTx{c}, nil
+}
+
+type fakeTx struct {
+	c *fakeConn
+}
+
+func (tx fakeTx) Commit() error {
+	tx.c.db.mu.Lock()
+	defer tx.c.db.mu.Unlock()
+	tx.c.db.commits++
+	tx.c.inTx, tx.c.undo = false, nil
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.c.db.mu.Lock()
+	defer tx.c.db.mu.Unlock()
+	tx.c.db.rollbacks++
+	for i := len(tx.c.undo) - 1; i >= 0; i-- {
+		tx.c.undo[i]()
+	}
+	tx.c.inTx, tx.c.undo = false, nil
+	return nil
+}
+
+// wait applies the configured delay and failures to a statement.
+func (c *fakeConn) wait(ctx context.Context, query string) error {
+	c.db.mu.Lock()
+	delay := c.db.delay
+	var failure error
+	for statement, err := range c.db.fail {
+		if strings.Contains(query, statement) {
+			failure = err
+		}
+	}
+	c.db.mu.Unlock()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return failure
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.wait(ctx, query); err != nil {
+		return nil, err
+	}
+	f := c.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := func() int { return int(args[0].Value.(int64)) }
+	switch {
+	case strings.Contains(query, "pg_advisory_unlock"):
+		if f.locks[id()] == c {
+			delete(f.locks, id())
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "insert into processed_videos (video_id, status, processed_at"):
+		if f.statuses[id()] == StatusDone {
+			return driver.RowsAffected(0), nil
+		}
+		c.write(id(), StatusDone)
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "insert into processed_videos"):
+		c.write(id(), VideoStatus(args[1].Value.(string)))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "insert into outbox"):
+		row := fakeOutboxRow{id: int64(len(f.outbox) + 1)}
+		row.message.Exchange = args[0].Value.(string)
+		row.message.RoutingKey = args[1].Value.(string)
+		row.message.Queue = args[2].Value.(string)
+		row.message.Payload = args[3].Value.([]byte)
+		row.message.ContentType = args[4].Value.(string)
+		row.headers = args[5].Value.([]byte)
+		row.correlationID = args[6].Value.(string)
+		f.outbox = append(f.outbox, row)
+		if c.inTx {
+			c.undo = append(c.undo, func() { f.outbox = f.outbox[:len(f.outbox)-1] })
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "update outbox set published_at"):
+		for i := range f.outbox {
+			if f.outbox[i].id == args[1].Value.(int64) {
+				f.outbox[i].published = true
+			}
+		}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "insert into process_errors_log"):
+		f.errors = append(f.errors, args[0].Value.([]byte))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "insert into conversion_results"):
+		f.results[id()] = args[7].Value.([]byte)
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("fakedb: unexpected statement %q", query)
+}
+
+// write sets a status, to be reverted if the transaction rolls back. The
+// caller holds the lock.
+func (c *fakeConn) write(videoID int, status VideoStatus) {
+	previous, existed := c.db.statuses[videoID]
+	c.db.statuses[videoID] = status
+	if c.inTx {
+		c.undo = append(c.undo, func() {
+			if existed {
+				c.db.statuses[videoID] = previous
+			} else {
+				delete(c.db.statuses, videoID)
+			}
+		})
+	}
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if err := c.wait(ctx, query); err != nil {
+		return nil, err
+	}
+	f := c.db
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := func() int { return int(args[0].Value.(int64)) }
+	switch {
+	case strings.Contains(query, "pg_try_advisory_lock"):
+		owner, held := f.locks[id()]
+		if !held {
+			f.locks[id()] = c
+		}
+		return &fakeRows{columns: []string{"locked"}, values: [][]driver.Value{{!held || owner == c}}}, nil
+	case strings.HasPrefix(query, "SELECT EXISTS(SELECT 1 FROM processed_videos"):
+		return &fakeRows{columns: []string{"exists"}, values: [][]driver.Value{{f.statuses[id()] == StatusDone}}}, nil
+	case strings.HasPrefix(query, "select status from processed_videos"):
+		status, ok := f.statuses[id()]
+		if !ok {
+			return &fakeRows{columns: []string{"status"}}, nil
+		}
+		return &fakeRows{columns: []string{"status"}, values: [][]driver.Value{{string(status)}}}, nil
+	case strings.HasPrefix(query, "select task from conversion_results"):
+		task, ok := f.results[id()]
+		if !ok {
+			return &fakeRows{columns: []string{"task"}}, nil
+		}
+		return &fakeRows{columns: []string{"task"}, values: [][]driver.Value{{task}}}, nil
+	case strings.HasPrefix(query, "select id, exchange, routing_key, queue, payload, content_type, headers"):
+		rows := &fakeRows{columns: []string{"id", "exchange", "routing_key", "queue", "payload", "content_type", "headers", "correlation_id"}}
+		for _, row := range f.outbox {
+			if !row.published {
+				rows.values = append(rows.values, []driver.Value{row.id, row.message.Exchange, row.message.RoutingKey,
+					row.message.Queue, row.message.Payload, row.message.ContentType, row.headers, row.correlationID})
+			}
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("fakedb: unexpected query %q", query)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
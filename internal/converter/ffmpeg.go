@@ -0,0 +1,288 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dashDir             = "mpeg-dash"
+	dashExt             = ".mpd"
+	hlsDir              = "hls"
+	hlsExt              = ".m3u8"
+	defaultManifestName = "output" + dashExt
+)
+
+// DefaultConversionTimeout is a generous bound for a single ffmpeg run.
+const DefaultConversionTimeout = 30 * time.Minute
+
+var ErrConversionTimeout = errors.New("ffmpeg conversion timed out")
+
+const (
+	defaultFFmpegOutputLimit = 4 << 10
+	ffmpegLogFile            = "ffmpeg.log"
+)
+
+// FFmpegError is returned when ffmpeg fails. Output holds the end of what it
+// printed, bounded by FFmpegOutputLimit, and is kept out of Error so it can be
+// logged as its own field. LogFile has the full output.
+type FFmpegError struct {
+	ExitCode int
+	Output   string
+	LogFile  string
+	Err      error
+}
+
+func (e *FFmpegError) Error() string {
+	return fmt.Sprintf("ffmpeg exited with code %d: %v", e.ExitCode, e.Err)
+}
+
+func (e *FFmpegError) Unwrap() error {
+	return e.Err
+}
+
+func newFFmpegError(err error, output *tailBuffer, logFile string) error {
+	if err == nil {
+		return nil
+	}
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	return &FFmpegError{ExitCode: exitCode, Output: string(output.buf), LogFile: logFile, Err: err}
+}
+
+// tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.limit {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.limit:]...)
+	}
+	return len(p), nil
+}
+
+func ValidateFFmpeg(ffmpegPath string) error {
+	output, err := exec.Command(ffmpegPath, "-version").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ffmpeg binary %q failed to run: %v, output: %s", ffmpegPath, err, output)
+	}
+	return nil
+}
+
+// acquireFFmpeg waits for a free ffmpeg slot or for ctx to be done. The
+// returned function frees the slot.
+func (vc *VideoConverter) acquireFFmpeg(ctx context.Context) (func(), error) {
+	if vc.ffmpegSlots == nil {
+		return func() {}, nil
+	}
+	select {
+	case vc.ffmpegSlots <- struct{}{}:
+		return func() { <-vc.ffmpegSlots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// runFFmpegCommand runs a short ffmpeg command, such as the thumbnail, in an
+// ffmpeg slot of its own.
+func (vc *VideoConverter) runFFmpegCommand(ctx context.Context, args ...string) ([]byte, error) {
+	release, err := vc.acquireFFmpeg(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return vc.options.Runner.Run(ctx, vc.options.FFmpegPath, args...)
+}
+
+// FFmpegInFlight returns how many ffmpeg processes hold a slot.
+func (vc *VideoConverter) FFmpegInFlight() int {
+	return len(vc.ffmpegSlots)
+}
+
+// ffmpegOutput describes where and how ffmpegArgs writes the conversion.
+type ffmpegOutput struct {
+	dir    string
+	format OutputFormat
+	// manifest is the manifest name without its extension.
+	manifest string
+	// keyInfoFile, when set, encrypts the HLS segments.
+	keyInfoFile string
+	// videoFilter and audioFilter, when set, apply to every output.
+	videoFilter string
+	audioFilter string
+}
+
+// ffmpegArgs builds the conversion arguments.
+func (vc *VideoConverter) ffmpegArgs(inputFile string, out ffmpegOutput) ([]string, error) {
+	if vc.options.SegmentDuration <= 0 {
+		return nil, fmt.Errorf("invalid segment duration %s: must be positive", vc.options.SegmentDuration)
+	}
+	if vc.options.FragmentDuration < 0 {
+		return nil, fmt.Errorf("invalid fragment duration %s: must not be negative", vc.options.FragmentDuration)
+	}
+
+	if err := validateRenditions(vc.options.Renditions); err != nil {
+		return nil, err
+	}
+
+	formats, err := out.format.formats()
+	if err != nil {
+		return nil, err
+	}
+
+	args := append([]string{"-y"}, vc.options.Accel.inputArgs()...)
+	args = append(args, "-i", inputFile)
+	for _, format := range formats {
+		args = append(args, renditionArgs(vc.options.Renditions, vc.options.AudioMode)...)
+		args = append(args, vc.options.Accel.outputArgs()...)
+		args = append(args, vc.options.AudioMode.outputArgs()...)
+		if out.videoFilter != "" {
+			args = append(args, "-vf", out.videoFilter)
+		}
+		if out.audioFilter != "" {
+			args = append(args, "-af", out.audioFilter)
+		}
+		args = append(args, vc.options.FFmpegExtraArgs...)
+		args = append(args, vc.muxerArgs(format, out)...)
+	}
+	return args, nil
+}
+
+func (vc *VideoConverter) muxerArgs(format OutputFormat, out ffmpegOutput) []string {
+	if format == FormatHLS {
+		return vc.hlsArgs(formatDir(out.dir, format), out.keyInfoFile, out.manifest)
+	}
+	return vc.dashArgs(formatDir(out.dir, format), out.manifest)
+}
+
+func (vc *VideoConverter) dashArgs(dir, manifest string) []string {
+	args := []string{
+		"-f", "dash",
+		"-seg_duration", formatSeconds(vc.options.SegmentDuration),
+	}
+	if vc.options.FragmentDuration > 0 {
+		args = append(args, "-frag_duration", formatSeconds(vc.options.FragmentDuration))
+	}
+	args = append(args, vc.container().args()...)
+	if len(vc.options.Renditions) > 0 {
+		adaptationSets := "id=0,streams=v id=1,streams=a"
+		if vc.options.AudioMode == AudioNone {
+			adaptationSets = "id=0,streams=v"
+		}
+		args = append(args, "-adaptation_sets", adaptationSets)
+	}
+	return append(args, filepath.Join(dir, manifest+dashExt))
+}
+
+func (vc *VideoConverter) hlsArgs(dir, keyInfoFile, manifest string) []string {
+	args := []string{
+		"-f", "hls",
+		"-hls_time", formatSeconds(vc.options.SegmentDuration),
+		"-hls_playlist_type", "vod",
+	}
+	if keyInfoFile != "" {
+		args = append(args, "-hls_key_info_file", keyInfoFile)
+	}
+	if len(vc.options.Renditions) == 0 {
+		return append(args,
+			"-hls_segment_filename", filepath.Join(dir, "segment_%03d.ts"),
+			filepath.Join(dir, manifest+hlsExt),
+		)
+	}
+
+	streamMap := make([]string, len(vc.options.Renditions))
+	for i := range vc.options.Renditions {
+		if vc.options.AudioMode == AudioNone {
+			streamMap[i] = fmt.Sprintf("v:%d", i)
+		} else {
+			streamMap[i] = fmt.Sprintf("v:%d,a:%d", i, i)
+		}
+	}
+	return append(args,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-master_pl_name", manifest+hlsExt,
+		"-hls_segment_filename", filepath.Join(dir, "stream_%v_%03d.ts"),
+		filepath.Join(dir, "stream_%v.m3u8"),
+	)
+}
+
+func renditionArgs(renditions []Rendition, audio AudioMode) []string {
+	var args []string
+	for range renditions {
+		args = append(args, "-map", "0:v:0")
+		if audio != AudioNone {
+			args = append(args, "-map", "0:a:0?")
+		}
+	}
+	for i, r := range renditions {
+		args = append(args,
+			fmt.Sprintf("-s:v:%d", i), fmt.Sprintf("%dx%d", r.Width, r.Height),
+			fmt.Sprintf("-b:v:%d", i), fmt.Sprintf("%dk", r.VideoBitrate),
+		)
+		if audio == AudioAAC {
+			args = append(args, fmt.Sprintf("-b:a:%d", i), fmt.Sprintf("%dk", r.AudioBitrate))
+		}
+	}
+	return args
+}
+
+// validateRenditions checks that the ladder is ordered from the highest to the
+// lowest quality without repeating a resolution.
+func validateRenditions(renditions []Rendition) error {
+	seen := make(map[[2]int]bool, len(renditions))
+	for i, r := range renditions {
+		if r.Width <= 0 || r.Height <= 0 {
+			return fmt.Errorf("invalid rendition %d: resolution %dx%d must be positive", i, r.Width, r.Height)
+		}
+		if r.VideoBitrate <= 0 || r.AudioBitrate <= 0 {
+			return fmt.Errorf("invalid rendition %d: bitrates must be positive", i)
+		}
+		resolution := [2]int{r.Width, r.Height}
+		if seen[resolution] {
+			return fmt.Errorf("invalid rendition %d: duplicate resolution %dx%d", i, r.Width, r.Height)
+		}
+		seen[resolution] = true
+		if i > 0 {
+			prev := renditions[i-1]
+			if r.Height > prev.Height || r.VideoBitrate > prev.VideoBitrate {
+				return fmt.Errorf("invalid rendition %d: ladder must be sorted from highest to lowest quality", i)
+			}
+		}
+	}
+	return nil
+}
+
+func validateExtraArgs(args []string) error {
+	for _, arg := range args {
+		if arg == "-i" {
+			return fmt.Errorf("extra ffmpeg args must not declare inputs: %q", arg)
+		}
+		if strings.HasSuffix(arg, dashExt) || strings.HasSuffix(arg, hlsExt) {
+			return fmt.Errorf("extra ffmpeg args must not contain output paths: %q", arg)
+		}
+	}
+	return nil
+}
+
+func formatDir(outputDir string, format OutputFormat) string {
+	if format == FormatHLS {
+		return filepath.Join(outputDir, hlsDir)
+	}
+	return filepath.Join(outputDir, dashDir)
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
@@ -0,0 +1,159 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFFmpegArgsTwoRenditionLadder(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{
+		Renditions: []Rendition{
+			{Width: 1920, Height: 1080, VideoBitrate: 5000, AudioBitrate: 192},
+			{Width: 1280, Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+		},
+	})
+	dir := t.TempDir()
+	args, err := vc.ffmpegArgs("merged.mp4", ffmpegOutput{dir: dir, format: FormatDASH, manifest: "output"})
+	if err != nil {
+		t.Fatalf("ffmpegArgs: %v", err)
+	}
+	want := []string{
+		"-y",
+		"-i", "merged.mp4",
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-s:v:0", "1920x1080", "-b:v:0", "5000k",
+		"-s:v:1", "1280x720", "-b:v:1", "2800k",
+		"-c:v", "libx264",
+		"-c:a", "copy",
+		"-f", "dash",
+		"-seg_duration", "4",
+		"-adaptation_sets", "id=0,streams=v id=1,streams=a",
+		filepath.Join(dir, dashDir, "output.mpd"),
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("ffmpegArgs =\n%q\nwant\n%q", args, want)
+	}
+}
+
+func TestFFmpegArgsSingleStream(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{})
+	dir := t.TempDir()
+	args, err := vc.ffmpegArgs("merged.mp4", ffmpegOutput{dir: dir, format: FormatDASH, manifest: "output"})
+	if err != nil {
+		t.Fatalf("ffmpegArgs: %v", err)
+	}
+	want := []string{
+		"-y",
+		"-i", "merged.mp4",
+		"-c:v", "libx264",
+		"-c:a", "copy",
+		"-f", "dash",
+		"-seg_duration", "4",
+		filepath.Join(dir, dashDir, "output.mpd"),
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("ffmpegArgs =\n%q\nwant\n%q", args, want)
+	}
+}
+
+func TestRenditionEncodeArgsForceSegmentKeyframes(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{SegmentDuration: 6 * time.Second, ParallelRenditions: 2})
+	rendition := Rendition{Width: 1280, Height: 720, VideoBitrate: 2800, AudioBitrate: 128}
+	args := vc.renditionEncodeArgs("merged.mp4", rendition, ffmpegOutput{}, "rendition_0.mkv")
+	want := []string{
+		"-i", "merged.mp4",
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-s:v", "1280x720", "-b:v", "2800k",
+		"-force_key_frames", "expr:gte(t,n_forced*6)",
+		"-c:v", "libx264",
+		"-c:a", "copy",
+		"-f", "matroska", "-y", "rendition_0.mkv",
+	}
+	if !reflect.DeepEqual(args, want) {
+		t.Errorf("renditionEncodeArgs =\n%q\nwant\n%q", args, want)
+	}
+}
+
+func TestEveryFFmpegRunHoldsASlot(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		most    int
+		vc      *VideoConverter
+	)
+	runner := &stubRunner{}
+	runner.run = func(_ context.Context, name string, _ ...string) ([]byte, error) {
+		if name == defaultFFprobePath {
+			return []byte(ffprobeJSON), nil
+		}
+		mu.Lock()
+		running++
+		most = max(most, running)
+		inFlight := vc.FFmpegInFlight()
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+		if inFlight != 1 {
+			return nil, fmt.Errorf("ffmpeg ran with %d slots taken", inFlight)
+		}
+		time.Sleep(10 * time.Millisecond)
+		return nil, nil
+	}
+	vc, _ = newTestConverter(t, ConversionOptions{
+		Runner:              runner,
+		MaxConcurrentFFmpeg: 1,
+		ParallelRenditions:  2,
+		Renditions: []Rendition{
+			{Width: 1280, Height: 720, VideoBitrate: 2800, AudioBitrate: 128},
+			{Width: 640, Height: 360, VideoBitrate: 800, AudioBitrate: 96},
+		},
+		GenerateThumbnail: true,
+		SpriteInterval:    time.Second,
+	})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	logs := captureLogs(t)
+
+	if _, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir}); err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	if strings.Contains(logs.String(), "slots taken") {
+		t.Errorf("an ffmpeg command ran outside of a slot:\n%s", logs)
+	}
+	if most != 1 {
+		t.Errorf("%d ffmpeg commands ran at once, want 1", most)
+	}
+	// Two renditions, the packaging, the thumbnail and the sprites.
+	if calls := len(runner.ffmpegCalls()); calls != 5 {
+		t.Errorf("ffmpeg ran %d times, want 5", calls)
+	}
+}
+
+func TestSlotWaitFailureIsAnFFmpegFailure(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{MaxConcurrentFFmpeg: 1})
+	release, err := vc.acquireFFmpeg(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = vc.processVideo(ctx, &VideoTask{VideoID: 1, Path: dir})
+	if !errors.Is(err, ErrFFmpeg) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("processVideo error = %v, want an ffmpeg failure wrapping the deadline", err)
+	}
+}
@@ -0,0 +1,47 @@
+package converter
+
+// Hooks are called at fixed points of a task. Every field is optional. Hooks
+// run synchronously on the worker, so they should return quickly.
+type Hooks struct {
+	// BeforeProcess runs once the task is locked, before the conversion.
+	BeforeProcess func(task VideoTask)
+	// AfterMerge runs once the chunks are merged and the result probed.
+	AfterMerge func(task VideoTask, mergedFile string, media *MediaInfo)
+	// AfterConvert runs once ffmpeg wrote the output directories.
+	AfterConvert func(task VideoTask, outputDirs []string)
+	// OnError runs when converting or confirming the task fails, before it
+	// is retried or dead-lettered.
+	OnError func(task VideoTask, err error)
+	// AfterPublish runs once the confirmation is stored for publishing.
+	AfterPublish func(task VideoTask, confirmation ConfirmationMessage)
+}
+
+func (h Hooks) beforeProcess(task VideoTask) {
+	if h.BeforeProcess != nil {
+		h.BeforeProcess(task)
+	}
+}
+
+func (h Hooks) afterMerge(task VideoTask, mergedFile string, media *MediaInfo) {
+	if h.AfterMerge != nil {
+		h.AfterMerge(task, mergedFile, media)
+	}
+}
+
+func (h Hooks) afterConvert(task VideoTask, outputDirs []string) {
+	if h.AfterConvert != nil {
+		h.AfterConvert(task, outputDirs)
+	}
+}
+
+func (h Hooks) onError(task VideoTask, err error) {
+	if h.OnError != nil {
+		h.OnError(task, err)
+	}
+}
+
+func (h Hooks) afterPublish(task VideoTask, confirmation ConfirmationMessage) {
+	if h.AfterPublish != nil {
+		h.AfterPublish(task, confirmation)
+	}
+}
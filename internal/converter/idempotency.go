@@ -1,38 +1,219 @@
-package converter
-
-import (
-	"database/sql"
-	"encoding/json"
-	"log/slog"
-	"time"
-)
-
-func IsProcessed(db *sql.DB, videoID int) bool {
-	var IsProcessed bool
-	query := "SELECT EXISTS(SELECT 1 FROM processed_videos where video_id = $1 and status='success')"
-	err := db.QueryRow(query, videoID).Scan(&IsProcessed)
-	if err != nil {
-		slog.Error("Error checking if video is processed", slog.Int("video_id", videoID))
-		return false
-	}
-	return IsProcessed
-}
-
-func MarkProcessed(db *sql.DB, videoID int) error {
-	query := "insert into processed_videos (video_id, status, processed_at) values ($1, $2, $3)"
-	_, err := db.Exec(query, videoID, "success", time.Now())
-	if err != nil {
-		slog.Error("Error marking video as processed", slog.Int("video_id", videoID))
-		return err
-	}
-	return nil
-}
-
-func RegisterError(db *sql.DB, errorData map[string]interface{}, err error) {
-	serializedError, _ := json.Marshal(errorData)
-	query := "insert into process_errors_log (error_details, created_at) values ($1, $2)"
-	_, dbErr := db.Exec(query, serializedError, time.Now())
-	if dbErr != nil {
-		slog.Error("Error registering error", slog.String("error_details", string(serializedError)))
-	}
-}
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+type VideoStatus string
+
+const (
+	StatusQueued     VideoStatus = "queued"
+	StatusProcessing VideoStatus = "processing"
+	StatusDone       VideoStatus = "done"
+	StatusFailed     VideoStatus = "failed"
+)
+
+// DBTimeoutError is returned when a database call does not complete within
+// the context deadline. The delivery can safely be requeued.
+type DBTimeoutError struct {
+	Op  string
+	Err error
+}
+
+func (e *DBTimeoutError) Error() string {
+	return fmt.Sprintf("database %s timed out: %v", e.Op, e.Err)
+}
+
+func (e *DBTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func isDBTimeout(err error) bool {
+	var timeoutErr *DBTimeoutError
+	return errors.As(err, &timeoutErr)
+}
+
+// dbError turns err into a DBTimeoutError when ctx expired.
+func dbError(ctx context.Context, op string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &DBTimeoutError{Op: op, Err: err}
+	}
+	return err
+}
+
+func IsProcessed(ctx context.Context, db *sql.DB, videoID int) (bool, error) {
+	var IsProcessed bool
+	query := "SELECT EXISTS(SELECT 1 FROM processed_videos where video_id = $1 and status='done')"
+	err := db.QueryRowContext(ctx, query, videoID).Scan(&IsProcessed)
+	if err != nil {
+		return false, dbError(ctx, "is processed", err)
+	}
+	return IsProcessed, nil
+}
+
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// MarkProcessed marks the video as done. It reports false when another worker
+// already did, in which case nothing changes.
+func MarkProcessed(ctx context.Context, db *sql.DB, videoID int) (bool, error) {
+	return markProcessed(ctx, db, videoID)
+}
+
+func markProcessed(ctx context.Context, db execer, videoID int) (bool, error) {
+	query := `insert into processed_videos (video_id, status, processed_at, updated_at) values ($1, $2, $3, $3)
+		on conflict (video_id) do update set status = excluded.status, processed_at = excluded.processed_at, updated_at = excluded.updated_at
+		where processed_videos.status <> excluded.status`
+	res, err := db.ExecContext(ctx, query, videoID, StatusDone, time.Now())
+	if err != nil {
+		slog.Error("Error marking video as processed", slog.Int("video_id", videoID))
+		return false, dbError(ctx, "mark processed", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// lockVideo takes a session-level advisory lock keyed on the video id so only
+// one worker converts a video at a time. It reports false without waiting when
+// another worker holds the lock. The returned function releases it.
+func lockVideo(ctx context.Context, db *sql.DB, videoID int) (func(), bool, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, dbError(ctx, "lock video", err)
+	}
+	var locked bool
+	err = conn.QueryRowContext(ctx, "select pg_try_advisory_lock($1)", videoID).Scan(&locked)
+	if err != nil || !locked {
+		conn.Close()
+		return nil, false, dbError(ctx, "lock video", err)
+	}
+	unlock := func() {
+		if _, err := conn.ExecContext(context.Background(), "select pg_advisory_unlock($1)", videoID); err != nil {
+			slog.Error("Error releasing video lock", slog.Int("video_id", videoID))
+		}
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+func SetStatus(ctx context.Context, db *sql.DB, videoID int, status VideoStatus) error {
+	query := `insert into processed_videos (video_id, status, updated_at) values ($1, $2, $3)
+		on conflict (video_id) do update set status = excluded.status, updated_at = excluded.updated_at`
+	_, err := db.ExecContext(ctx, query, videoID, status, time.Now())
+	if err != nil {
+		slog.Error("Error setting video status", slog.Int("video_id", videoID), slog.String("status", string(status)))
+		return dbError(ctx, "set status", err)
+	}
+	return nil
+}
+
+// GetStatus returns the current status of the video, or StatusQueued when the
+// video has not been picked up yet.
+func GetStatus(ctx context.Context, db *sql.DB, videoID int) (VideoStatus, error) {
+	var status VideoStatus
+	query := "select status from processed_videos where video_id = $1"
+	err := db.QueryRowContext(ctx, query, videoID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return StatusQueued, nil
+	}
+	if err != nil {
+		return "", dbError(ctx, "get status", err)
+	}
+	return status, nil
+}
+
+// MarkProcessedWithOutbox marks the video as processed and stores its
+// confirmation in the outbox within a single transaction, so the confirmation
+// is never lost once the video is considered done. Like MarkProcessed it
+// reports false, without writing the confirmation, when the video was
+// already done.
+func MarkProcessedWithOutbox(ctx context.Context, db *sql.DB, videoID int, message OutboxMessage) (bool, error) {
+	var marked bool
+	err := InTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		marked, err = MarkProcessedTx(ctx, tx, videoID)
+		if err != nil || !marked {
+			return err
+		}
+		if err := EnqueueOutbox(ctx, tx, message); err != nil {
+			slog.Error("Error writing confirmation to outbox", slog.Int("video_id", videoID))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return false, dbError(ctx, "mark processed", err)
+	}
+	return marked, nil
+}
+
+// InTx runs fn in a transaction, committing when it returns nil and rolling
+// back otherwise. Together with MarkProcessedTx and EnqueueOutbox it lets
+// callers add their own writes to the transaction that confirms a video.
+func InTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func MarkProcessedTx(ctx context.Context, tx *sql.Tx, videoID int) (bool, error) {
+	return markProcessed(ctx, tx, videoID)
+}
+
+const (
+	registerErrorAttempts = 3
+	registerErrorBackoff  = 200 * time.Millisecond
+)
+
+// ErrorRecord is the error_details document stored in process_errors_log.
+type ErrorRecord struct {
+	VideoID       int       `json:"video_id"`
+	TraceID       string    `json:"trace_id,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Error         string    `json:"error"`
+	Details       string    `json:"details"`
+	Time          time.Time `json:"time"`
+	// ExitCode, FFmpegTail and FFmpegLog are set when ffmpeg itself failed.
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	FFmpegTail string `json:"ffmpeg_tail,omitempty"`
+	FFmpegLog  string `json:"ffmpeg_log,omitempty"`
+}
+
+// RegisterError stores record, retrying a few times so a transient database
+// failure does not lose it.
+func RegisterError(ctx context.Context, db *sql.DB, record ErrorRecord) error {
+	serializedError, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	query := "insert into process_errors_log (error_details, created_at) values ($1, $2)"
+	backoff := registerErrorBackoff
+	for attempt := 1; ; attempt++ {
+		_, err = db.ExecContext(ctx, query, serializedError, record.Time)
+		if err == nil || attempt == registerErrorAttempts {
+			return dbError(ctx, "register error", err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return dbError(ctx, "register error", err)
+		}
+		backoff *= 2
+	}
+}
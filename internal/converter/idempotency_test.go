@@ -0,0 +1,196 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// blockingRunner holds every ffmpeg run until release is closed, failing it
+// with err.
+func blockingRunner(started chan<- struct{}, release <-chan struct{}, err error) *stubRunner {
+	return &stubRunner{run: func(ctx context.Context, name string, args ...string) ([]byte, error) {
+		if name == defaultFFprobePath {
+			return []byte(ffprobeJSON), nil
+		}
+		started <- struct{}{}
+		select {
+		case <-release:
+			return nil, err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}}
+}
+
+func TestConcurrentDeliveriesConvertOnce(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	runner := blockingRunner(started, release, nil)
+	metrics := &recordingMetrics{}
+	vc, fake := newTestConverter(t, ConversionOptions{Runner: runner, Metrics: metrics, LockRetryDelay: time.Millisecond})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	task := VideoTask{VideoID: 1, Path: dir}
+
+	first, firstAck := newDelivery(t, task)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handle(context.Background(), vc, first)
+	}()
+	<-started
+
+	// The duplicate arrives while the first worker converts the video.
+	duplicate, duplicateAck := newDelivery(t, task)
+	handle(context.Background(), vc, duplicate)
+	if outcome := duplicateAck.outcome(); outcome != "requeue" {
+		t.Fatalf("duplicate delivery was %s, want requeue", outcome)
+	}
+	if requeues := metrics.requeues(); !reflect.DeepEqual(requeues, []string{requeueLocked}) {
+		t.Errorf("requeues = %q, want one %q", requeues, requeueLocked)
+	}
+
+	close(release)
+	<-done
+	if outcome := firstAck.outcome(); outcome != "ack" {
+		t.Fatalf("first delivery was %s, want ack", outcome)
+	}
+	if fake.locked(1) {
+		t.Error("video lock still held after the task finished")
+	}
+
+	// The requeued duplicate comes back once the video is done.
+	redelivered, redeliveredAck := newDelivery(t, task)
+	handle(context.Background(), vc, redelivered)
+	if outcome := redeliveredAck.outcome(); outcome != "ack" {
+		t.Errorf("redelivered duplicate was %s, want ack", outcome)
+	}
+	if calls := len(runner.ffmpegCalls()); calls != 1 {
+		t.Errorf("ffmpeg ran %d times, want once", calls)
+	}
+	if rows := fake.outboxRows(); len(rows) != 1 {
+		t.Errorf("outbox has %d confirmations, want 1", len(rows))
+	}
+}
+
+func TestLockReleasedBeforeRetryIsPublished(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	close(release)
+	runner := blockingRunner(started, release, errors.New("exit status 1"))
+	vc, fake := newTestConverter(t, ConversionOptions{Runner: runner, RetryBackoff: time.Millisecond})
+	broker := vc.rabbitmqClient.(*fakeBroker)
+	var lockedAtPublish bool
+	broker.onPublish = func() { lockedAtPublish = fake.locked(1) }
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	handle(context.Background(), vc, d)
+	<-started
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Fatalf("delivery was %s, want ack after republishing it", outcome)
+	}
+	if len(broker.messages()) != 1 {
+		t.Fatalf("published %+v, want the retry", broker.messages())
+	}
+	if lockedAtPublish {
+		t.Error("retry was published while the video lock was held")
+	}
+}
+
+func TestMarkProcessedWithOutboxIsAtomic(t *testing.T) {
+	fake, db := newFakeDB(t)
+	ctx := context.Background()
+	fake.failOn("insert into outbox", errors.New("outbox unavailable"))
+
+	marked, err := MarkProcessedWithOutbox(ctx, db, 1, OutboxMessage{Payload: []byte(`{}`)})
+	if err == nil || marked {
+		t.Fatalf("MarkProcessedWithOutbox = %v, %v, want the outbox error", marked, err)
+	}
+	if status := fake.status(1); status == StatusDone {
+		t.Error("video marked as done although its confirmation was not stored")
+	}
+	if commits, rollbacks := fake.transactions(); commits != 0 || rollbacks != 1 {
+		t.Errorf("commits = %d, rollbacks = %d, want the transaction rolled back", commits, rollbacks)
+	}
+
+	fake.failOn("insert into outbox", nil)
+	marked, err = MarkProcessedWithOutbox(ctx, db, 1, OutboxMessage{Payload: []byte(`{}`)})
+	if err != nil || !marked {
+		t.Fatalf("MarkProcessedWithOutbox = %v, %v", marked, err)
+	}
+	if status := fake.status(1); status != StatusDone {
+		t.Errorf("status = %q, want %q", status, StatusDone)
+	}
+	if rows := fake.outboxRows(); len(rows) != 1 {
+		t.Errorf("outbox has %d rows, want 1", len(rows))
+	}
+
+	// A second confirmation of a done video writes nothing.
+	marked, err = MarkProcessedWithOutbox(ctx, db, 1, OutboxMessage{Payload: []byte(`{}`)})
+	if err != nil || marked {
+		t.Fatalf("MarkProcessedWithOutbox = %v, %v, want false for a done video", marked, err)
+	}
+	if rows := fake.outboxRows(); len(rows) != 1 {
+		t.Errorf("outbox has %d rows, want 1", len(rows))
+	}
+}
+
+func TestHandleRetriesWhenConfirmationCannotBeStored(t *testing.T) {
+	vc, fake := newTestConverter(t, ConversionOptions{RetryBackoff: time.Millisecond})
+	fake.failOn("insert into outbox", errors.New("outbox unavailable"))
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	handle(context.Background(), vc, d)
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Fatalf("delivery was %s, want ack after republishing it", outcome)
+	}
+	if published := vc.rabbitmqClient.(*fakeBroker).messages(); len(published) != 1 || published[0].exchange != "conversion" {
+		t.Errorf("published %+v, want the task republished", published)
+	}
+	if status := fake.status(1); status == StatusDone {
+		t.Error("video marked as done without a confirmation")
+	}
+}
+
+func TestSlowDatabaseRequeuesTask(t *testing.T) {
+	metrics := &recordingMetrics{}
+	vc, fake := newTestConverter(t, ConversionOptions{DBTimeout: 20 * time.Millisecond, Metrics: metrics})
+	fake.delay = time.Second
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	ctx, cancel := vc.dbContext(context.Background())
+	_, err := IsProcessed(ctx, vc.db, 1)
+	cancel()
+	var timeoutErr *DBTimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Errorf("IsProcessed error = %v, want a DBTimeoutError", err)
+	}
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 2, Path: dir})
+	start := time.Now()
+	handle(context.Background(), vc, d)
+
+	if took := time.Since(start); took > fake.delay/2 {
+		t.Errorf("Handle took %s, want it bounded by DBTimeout", took)
+	}
+	if outcome := ack.outcome(); outcome != "requeue" {
+		t.Errorf("delivery was %s, want requeue", outcome)
+	}
+	if published := vc.rabbitmqClient.(*fakeBroker).messages(); len(published) != 0 {
+		t.Errorf("published = %+v, want nothing before the database answers", published)
+	}
+	if !reflect.DeepEqual(metrics.failed, []Stage{StageDB}) {
+		t.Errorf("failed stages = %v, want [%s]", metrics.failed, StageDB)
+	}
+	if calls := len(vc.options.Runner.(*stubRunner).ffmpegCalls()); calls != 0 {
+		t.Errorf("ffmpeg ran %d times against an unreachable database", calls)
+	}
+}
@@ -0,0 +1,88 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// StartJanitor removes output directories under OutputBaseDir whose video was
+// marked done more than retention ago, every interval until ctx is cancelled.
+// Directories of videos that are not done, or that a worker holds the lock
+// for, are kept. With JanitorDryRun set it only logs what it would remove.
+func (vc *VideoConverter) StartJanitor(ctx context.Context, interval, retention time.Duration) {
+	root := vc.options.OutputBaseDir
+	if root == "" || !vc.localStorage() {
+		slog.Warn("Janitor disabled, outputs are not stored under OutputBaseDir")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		vc.sweepOutputs(ctx, root, time.Now().Add(-retention))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (vc *VideoConverter) sweepOutputs(ctx context.Context, root string, cutoff time.Time) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		slog.Error("Janitor failed to list outputs", slog.String("path", root), slog.String("error", err.Error()))
+		return
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		videoID, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		if err := vc.removeExpiredOutput(ctx, filepath.Join(root, entry.Name()), videoID, cutoff); err != nil {
+			slog.Error("Janitor failed to remove output", slog.Int("video_id", videoID), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// removeExpiredOutput removes dir while holding the video lock, so a task
+// reprocessing the video cannot start in between the check and the removal.
+func (vc *VideoConverter) removeExpiredOutput(ctx context.Context, dir string, videoID int, cutoff time.Time) error {
+	dbCtx, cancel := vc.dbContext(ctx)
+	defer cancel()
+	unlock, locked, err := lockVideo(dbCtx, vc.db, videoID)
+	if err != nil || !locked {
+		return err
+	}
+	defer unlock()
+
+	expired, err := outputExpired(dbCtx, vc.db, videoID, cutoff)
+	if err != nil || !expired {
+		return err
+	}
+	if vc.options.JanitorDryRun {
+		slog.Info("Janitor would remove output", slog.Int("video_id", videoID), slog.String("path", dir))
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	slog.Info("Janitor removed output", slog.Int("video_id", videoID), slog.String("path", dir))
+	return nil
+}
+
+func outputExpired(ctx context.Context, db *sql.DB, videoID int, cutoff time.Time) (bool, error) {
+	var expired bool
+	query := "select exists(select 1 from processed_videos where video_id = $1 and status = $2 and processed_at < $3)"
+	if err := db.QueryRowContext(ctx, query, videoID, StatusDone, cutoff).Scan(&expired); err != nil {
+		return false, dbError(ctx, "check output expiry", err)
+	}
+	return expired, nil
+}
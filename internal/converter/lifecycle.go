@@ -0,0 +1,93 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// abortGrace is how long Shutdown waits for cancelled tasks to requeue their
+// deliveries before closing the connections.
+const abortGrace = 10 * time.Second
+
+// begin registers an in-flight task. It returns false once Shutdown started,
+// in which case the task must not be processed.
+func (vc *VideoConverter) begin() bool {
+	vc.mu.Lock()
+	defer vc.mu.Unlock()
+	if vc.shuttingDown {
+		return false
+	}
+	vc.inFlight.Add(1)
+	return true
+}
+
+// abortable returns a context that is also cancelled when Shutdown aborts the
+// running tasks.
+func (vc *VideoConverter) abortable(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(vc.aborted, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// Shutdown stops consuming new deliveries, waits for in-flight tasks to finish
+// or ctx to expire, and then calls Close. Tasks still running at the deadline
+// are cancelled and their deliveries requeued.
+func (vc *VideoConverter) Shutdown(ctx context.Context) error {
+	vc.mu.Lock()
+	vc.shuttingDown = true
+	vc.mu.Unlock()
+
+	slog.Info("Shutting down, waiting for in-flight tasks")
+	var errs []error
+	if err := vc.rabbitmqClient.StopConsuming(); err != nil {
+		errs = append(errs, err)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		vc.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("All in-flight tasks finished")
+	case <-ctx.Done():
+		slog.Warn("Shutdown deadline reached, cancelling running tasks")
+		errs = append(errs, ctx.Err())
+		vc.abort()
+		select {
+		case <-drained:
+			slog.Info("Cancelled tasks requeued")
+		case <-time.After(abortGrace):
+			slog.Error("Cancelled tasks did not finish in time")
+		}
+	}
+
+	if err := vc.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the database and the RabbitMQ client when the converter owns
+// them, see ConversionOptions.OwnResources. It does not wait for running
+// tasks; use Shutdown for that.
+func (vc *VideoConverter) Close() error {
+	if !vc.options.OwnResources {
+		return nil
+	}
+	var errs []error
+	if err := vc.db.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close database: %w", err))
+	}
+	if err := vc.rabbitmqClient.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close rabbitmq client: %w", err))
+	}
+	return errors.Join(errs...)
+}
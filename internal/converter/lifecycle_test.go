@@ -0,0 +1,71 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestShutdownRequeuesRunningTask(t *testing.T) {
+	started := make(chan struct{}, 1)
+	// ffmpeg never finishes on its own.
+	runner := blockingRunner(started, nil, nil)
+	vc, fake := newTestConverter(t, ConversionOptions{Runner: runner})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handle(context.Background(), vc, d)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := vc.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown error = %v, want the deadline", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Handle did not return after Shutdown")
+	}
+	if outcome := ack.outcome(); outcome != "requeue" {
+		t.Errorf("delivery was %s, want requeue", outcome)
+	}
+	if fake.locked(1) {
+		t.Error("video lock still held after Shutdown")
+	}
+
+	// Deliveries that arrive once shutting down are requeued untouched.
+	late, lateAck := newDelivery(t, VideoTask{VideoID: 2, Path: dir})
+	handle(context.Background(), vc, late)
+	if outcome := lateAck.outcome(); outcome != "requeue" {
+		t.Errorf("late delivery was %s, want requeue", outcome)
+	}
+	if calls := len(runner.ffmpegCalls()); calls != 1 {
+		t.Errorf("ffmpeg ran %d times, want once", calls)
+	}
+}
+
+func TestShutdownWaitsForRunningTask(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	vc, _ := newTestConverter(t, ConversionOptions{Runner: blockingRunner(started, release, nil)})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	go handle(context.Background(), vc, d)
+	<-started
+	time.AfterFunc(20*time.Millisecond, func() { close(release) })
+
+	if err := vc.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Errorf("delivery was %s, want ack", outcome)
+	}
+}
@@ -0,0 +1,77 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTargetLoudness = -16.0
+	loudnessTruePeak      = -1.5
+	loudnessRange         = 11.0
+)
+
+// loudnessStats are the values the loudnorm analysis pass prints as JSON.
+type loudnessStats struct {
+	InputI      string `json:"input_i"`
+	InputTP     string `json:"input_tp"`
+	InputLRA    string `json:"input_lra"`
+	InputThresh string `json:"input_thresh"`
+	Offset      string `json:"target_offset"`
+}
+
+// loudnessFilter runs the loudnorm analysis pass over inputFile and returns
+// the filter for the second pass. It returns an empty filter when the input
+// has no audio or is silent.
+func (vc *VideoConverter) loudnessFilter(ctx context.Context, task *VideoTask, inputFile string, media *MediaInfo) (string, error) {
+	if media.AudioCodec == "" {
+		task.log().Info("No audio stream, skipping loudness normalization")
+		return "", nil
+	}
+	target := fmt.Sprintf("I=%g:TP=%g:LRA=%g", vc.options.TargetLoudness, loudnessTruePeak, loudnessRange)
+	output, err := vc.options.Runner.Run(ctx, vc.options.FFmpegPath,
+		"-hide_banner", "-nostats",
+		"-i", inputFile,
+		"-map", "0:a:0",
+		"-af", "loudnorm="+target+":print_format=json",
+		"-f", "null", "-",
+	)
+	if err != nil {
+		return "", fmt.Errorf("loudness analysis failed: %w", err)
+	}
+	stats, err := parseLoudnessStats(output)
+	if err != nil {
+		return "", err
+	}
+	measured, err := strconv.ParseFloat(stats.InputI, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid measured loudness %q: %v", stats.InputI, err)
+	}
+	if math.IsInf(measured, 0) {
+		task.log().Info("Audio is silent, skipping loudness normalization")
+		return "", nil
+	}
+	return fmt.Sprintf("loudnorm=%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		target, stats.InputI, stats.InputTP, stats.InputLRA, stats.InputThresh, stats.Offset), nil
+}
+
+// parseLoudnessStats extracts the JSON block loudnorm prints at the end of
+// the ffmpeg output.
+func parseLoudnessStats(output []byte) (*loudnessStats, error) {
+	text := string(output)
+	start := strings.LastIndex(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("loudness analysis printed no measurements")
+	}
+	var stats loudnessStats
+	if err := json.Unmarshal([]byte(text[start:end+1]), &stats); err != nil {
+		return nil, fmt.Errorf("failed to parse loudness measurements: %v", err)
+	}
+	return &stats, nil
+}
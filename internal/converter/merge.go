@@ -0,0 +1,391 @@
+package converter
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imersaofc/internal/storage"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoChunks         = errors.New("no chunks found")
+	ErrChecksumMismatch = errors.New("chunk checksum mismatch")
+	ErrEmptyMerge       = errors.New("merged file is empty")
+)
+
+type MergeMismatchError struct {
+	Field    string
+	Expected int64
+	Actual   int64
+}
+
+func (e *MergeMismatchError) Error() string {
+	return fmt.Sprintf("merged %s mismatch: expected %d, got %d", e.Field, e.Expected, e.Actual)
+}
+
+var digitsRe = regexp.MustCompile(`\d+`)
+
+func (vc *VideoConverter) extractNumber(fileName string) (int, error) {
+	groups := digitsRe.FindAllString(strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)), -1)
+	if len(groups) == 0 {
+		return 0, fmt.Errorf("%w: chunk %s has no numeric index", ErrInvalidInput, filepath.Base(fileName))
+	}
+	numStr := groups[len(groups)-1]
+	if vc.options.ChunkIndex == ChunkIndexFirst {
+		numStr = groups[0]
+	}
+	num, err := strconv.Atoi(numStr)
+	if err != nil {
+		return 0, fmt.Errorf("%w: chunk %s has an invalid index: %v", ErrInvalidInput, filepath.Base(fileName), err)
+	}
+	return num, nil
+}
+
+type chunkFile struct {
+	path  string
+	index int
+}
+
+type MissingChunksError struct {
+	Missing []int
+}
+
+func (e *MissingChunksError) Error() string {
+	if len(e.Missing) == 1 {
+		return fmt.Sprintf("missing chunk %d", e.Missing[0])
+	}
+	missing := make([]string, len(e.Missing))
+	for i, index := range e.Missing {
+		missing[i] = strconv.Itoa(index)
+	}
+	return fmt.Sprintf("missing chunks %s", strings.Join(missing, ", "))
+}
+
+// sequenceErrors checks that the indices, in merge order, form a gapless
+// ascending sequence starting at start.
+func sequenceErrors(indices []int, start int) []error {
+	var errs []error
+	var missing []int
+	next := start
+	for i, index := range indices {
+		switch {
+		case index < start:
+			errs = append(errs, fmt.Errorf("unexpected chunk %d before first chunk %d", index, start))
+			continue
+		case i > 0 && index == indices[i-1]:
+			errs = append(errs, fmt.Errorf("duplicate chunk %d", index))
+			continue
+		case i > 0 && index < indices[i-1]:
+			errs = append(errs, fmt.Errorf("chunk %d out of order after chunk %d", index, indices[i-1]))
+			continue
+		}
+		for ; next < index; next++ {
+			missing = append(missing, next)
+		}
+		next = index + 1
+	}
+	if len(missing) > 0 {
+		errs = append(errs, &MissingChunksError{Missing: missing})
+	}
+	return errs
+}
+
+// orderChunks extracts the index of every chunk and sorts them with chunkLess.
+func (vc *VideoConverter) orderChunks(files []string) ([]chunkFile, error) {
+	chunks := make([]chunkFile, 0, len(files))
+	for _, file := range files {
+		index, err := vc.extractNumber(file)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunkFile{path: file, index: index})
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunkLess(chunks[i], chunks[j])
+	})
+	return chunks, nil
+}
+
+var segmentRe = regexp.MustCompile(`\d+|\D+`)
+
+// chunkLess orders chunks by the index ChunkIndex picked, and chunks sharing
+// an index with a natural sort of their names, so the order is stable.
+func chunkLess(a, b chunkFile) bool {
+	if a.index != b.index {
+		return a.index < b.index
+	}
+	return naturalLess(filepath.Base(a.path), filepath.Base(b.path))
+}
+
+// naturalLess splits both names into alternating text and number segments and
+// compares them segment by segment, numbers by value.
+func naturalLess(a, b string) bool {
+	as, bs := segmentRe.FindAllString(a, -1), segmentRe.FindAllString(b, -1)
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		if isDigits(as[i]) && isDigits(bs[i]) {
+			an, bn := strings.TrimLeft(as[i], "0"), strings.TrimLeft(bs[i], "0")
+			if len(an) != len(bn) {
+				return len(an) < len(bn)
+			}
+			if an != bn {
+				return an < bn
+			}
+			continue
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
+
+func isDigits(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+func (vc *VideoConverter) listChunks(inputDir string) ([]string, error) {
+	files, err := vc.options.Storage.List(storage.DirPrefix(inputDir))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []string
+	for _, file := range files {
+		if match, _ := filepath.Match(vc.options.ChunkPattern, filepath.Base(file)); match {
+			chunks = append(chunks, file)
+		}
+	}
+	return chunks, nil
+}
+
+// verifyChunk compares the SHA-256 of a chunk with the one sent in the task,
+// if any.
+func (vc *VideoConverter) verifyChunk(task *VideoTask, chunk string, buf []byte) error {
+	expected, ok := task.Checksums[filepath.Base(chunk)]
+	if !ok {
+		return nil
+	}
+	input, err := vc.options.Storage.Open(chunk)
+	if err != nil {
+		return fmt.Errorf("failed to read chunk file: %v", err)
+	}
+	defer input.Close()
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(hash, input, buf); err != nil {
+		return fmt.Errorf("failed to hash chunk %s: %v", chunk, err)
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		task.log().Error("Chunk failed verification", slog.String("chunk", chunk),
+			slog.String("expected", expected), slog.String("actual", actual))
+		return fmt.Errorf("%w: %s expected %s, got %s", ErrChecksumMismatch, filepath.Base(chunk), expected, actual)
+	}
+	return nil
+}
+
+func (vc *VideoConverter) noChunksError(dir string) error {
+	return fmt.Errorf("%w for pattern %q in dir %s", ErrNoChunks, vc.options.ChunkPattern, dir)
+}
+
+// writerOnly hides io.ReaderFrom so io.CopyBuffer actually uses our buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+// ctxReader stops reading as soon as ctx is done, so a shutdown aborts the
+// merge in the middle of a large chunk.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, fmt.Errorf("merge cancelled: %w", err)
+	}
+	return r.r.Read(p)
+}
+
+// mergeChunks concatenates the task chunks in numeric order into outputFile
+// and returns the number of bytes written along with the merged chunks in
+// order. Progress is recorded in a
+// .merge-state file next to outputFile so a merge interrupted by cancellation
+// resumes after the last complete chunk instead of starting over.
+func (vc *VideoConverter) mergeChunks(ctx context.Context, task *VideoTask, outputFile string) (written int64, merged []string, err error) {
+	inputDir := task.Path
+	// Get all chunk files in the input directory
+	files, err := vc.listChunks(inputDir)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to find chunks: %v", err)
+	}
+	task.log().Info("Found chunks", slog.String("path", inputDir), slog.Int("chunks", len(files)))
+	if len(files) == 0 {
+		return 0, nil, vc.noChunksError(inputDir)
+	}
+	if task.ExpectedChunks > 0 && len(files) != task.ExpectedChunks {
+		return 0, nil, &MergeMismatchError{Field: "chunk count", Expected: int64(task.ExpectedChunks), Actual: int64(len(files))}
+	}
+	chunks, err := vc.orderChunks(files)
+	if err != nil {
+		return 0, nil, err
+	}
+	indices := make([]int, len(chunks))
+	for i, chunk := range chunks {
+		indices[i] = chunk.index
+	}
+	if errs := sequenceErrors(indices, vc.options.FirstChunkIndex); len(errs) > 0 {
+		return 0, nil, errors.Join(errs...)
+	}
+	stateFile := outputFile + mergeStateSuffix
+	defer func() {
+		// Only an interrupted merge is worth resuming.
+		if err == nil || ctx.Err() == nil {
+			os.Remove(stateFile)
+		}
+	}()
+	state := resumeState(stateFile, outputFile, chunks)
+	if state.Chunks > 0 {
+		task.log().Info("Resuming merge", slog.Int("chunks", state.Chunks), slog.Int64("offset", state.Offset))
+	}
+	output, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create output file: %v", err)
+	}
+	defer output.Close()
+	// Drops whatever was written after the last recorded chunk.
+	if err := output.Truncate(state.Offset); err != nil {
+		return 0, nil, fmt.Errorf("failed to truncate output file: %v", err)
+	}
+	if _, err := output.Seek(state.Offset, io.SeekStart); err != nil {
+		return 0, nil, fmt.Errorf("failed to seek output file: %v", err)
+	}
+	written = state.Offset
+	buf := make([]byte, vc.options.MergeBufferSize)
+	for _, chunk := range chunks[state.Chunks:] {
+		if err := ctx.Err(); err != nil {
+			return 0, nil, fmt.Errorf("merge cancelled: %w", err)
+		}
+		if err := vc.verifyChunk(task, chunk.path, buf); err != nil {
+			return 0, nil, err
+		}
+		input, err := vc.options.Storage.Open(chunk.path)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read chunk file: %v", err)
+		}
+		n, err := io.CopyBuffer(writerOnly{output}, ctxReader{ctx: ctx, r: input}, buf)
+		input.Close()
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to write chunk %s to merged file: %w", chunk.path, err)
+		}
+		written += n
+		state = mergeState{Chunks: state.Chunks + 1, LastIndex: chunk.index, Offset: written}
+		if err := state.save(stateFile); err != nil {
+			task.log().Warn("Failed to record merge state", slog.String("error", err.Error()))
+		}
+		if vc.options.OnMergeProgress != nil {
+			vc.options.OnMergeProgress(task.VideoID, written)
+		}
+	}
+	if err := vc.checkMerged(outputFile); err != nil {
+		return 0, nil, err
+	}
+	if task.ExpectedSize > 0 && written != task.ExpectedSize {
+		return written, nil, &MergeMismatchError{Field: "size", Expected: task.ExpectedSize, Actual: written}
+	}
+	merged = make([]string, len(chunks))
+	for i, chunk := range chunks {
+		merged[i] = chunk.path
+	}
+	return written, merged, nil
+}
+
+// checkMerged makes sure the merged file exists and holds at least
+// MinMergedSize bytes before it is handed to ffmpeg.
+func (vc *VideoConverter) checkMerged(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrEmptyMerge, err)
+	}
+	if info.Size() < vc.options.MinMergedSize {
+		return fmt.Errorf("%w: %s has %d bytes, need at least %d", ErrEmptyMerge, path, info.Size(), vc.options.MinMergedSize)
+	}
+	return nil
+}
+
+const mergeStateSuffix = ".merge-state"
+
+// mergeState records how far a merge got: the number of chunks appended, the
+// index of the last one and the size of the merged file after it.
+type mergeState struct {
+	Chunks    int   `json:"chunks"`
+	LastIndex int   `json:"last_index"`
+	Offset    int64 `json:"offset"`
+}
+
+// resumeState returns the state to resume from, or the zero state when there
+// is none or it does not match the chunks and the merged file.
+func resumeState(stateFile, outputFile string, chunks []chunkFile) mergeState {
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return mergeState{}
+	}
+	var state mergeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		slog.Warn("Ignoring corrupt merge state", slog.String("path", stateFile), slog.String("error", err.Error()))
+		return mergeState{}
+	}
+	if state.Chunks <= 0 || state.Chunks > len(chunks) || chunks[state.Chunks-1].index != state.LastIndex || state.Offset < 0 {
+		return mergeState{}
+	}
+	info, err := os.Stat(outputFile)
+	if err != nil || info.Size() < state.Offset {
+		return mergeState{}
+	}
+	return state
+}
+
+// save replaces the state file atomically so a crash never leaves it half
+// written.
+func (s mergeState) save(stateFile string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile)
+}
+
+// removeChunks deletes the given chunks, which must be the ones that were
+// merged: chunks uploaded since then are left alone.
+func (vc *VideoConverter) removeChunks(task VideoTask, chunks []string) {
+	var removed int
+	var reclaimed int64
+	for _, chunk := range chunks {
+		size, err := vc.options.Storage.Size(chunk)
+		if err != nil {
+			vc.logError(task, "Failed to stat chunk "+chunk, err)
+			break
+		}
+		if err := vc.options.Storage.Remove(chunk); err != nil {
+			vc.logError(task, "Failed to remove chunk "+chunk, err)
+			break
+		}
+		removed++
+		reclaimed += size
+	}
+	task.log().Info("Removed merged chunks", slog.Int("chunks", removed), slog.Int64("bytes", reclaimed))
+}
@@ -0,0 +1,443 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"imersaofc/internal/storage"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChunksRemovedAfterSuccess(t *testing.T) {
+	vc, fake := newTestConverter(t, ConversionOptions{RemoveChunksAfterMerge: true})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk", "chunk_2.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	handle(context.Background(), vc, d)
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Fatalf("delivery was %s, want ack", outcome)
+	}
+	if status := fake.status(1); status != StatusDone {
+		t.Errorf("status = %q, want %q", status, StatusDone)
+	}
+	if left := chunksIn(t, dir, "*.chunk"); len(left) != 0 {
+		t.Errorf("chunks left after success: %v", left)
+	}
+	if _, err := os.Stat(filepath.Join(dir, dashDir)); err != nil {
+		t.Errorf("output was removed with the chunks: %v", err)
+	}
+}
+
+func TestChunksKeptAfterMergeFailure(t *testing.T) {
+	vc, fake := newTestConverter(t, ConversionOptions{RemoveChunksAfterMerge: true, RetryBackoff: time.Millisecond})
+	dir := t.TempDir()
+	// Chunk 1 is missing, so the merge fails.
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_2.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	handle(context.Background(), vc, d)
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Fatalf("delivery was %s, want ack after republishing it", outcome)
+	}
+	if published := vc.rabbitmqClient.(*fakeBroker).messages(); len(published) != 1 || published[0].exchange != "conversion" {
+		t.Errorf("published = %+v, want the task republished for a retry", published)
+	}
+	if status := fake.status(1); status != StatusFailed {
+		t.Errorf("status = %q, want %q", status, StatusFailed)
+	}
+	if left := chunksIn(t, dir, "*.chunk"); len(left) != 2 {
+		t.Errorf("chunks left after a merge failure = %v, want both", left)
+	}
+}
+
+func TestExtractNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy ChunkIndex
+		want     int
+		wantErr  bool
+	}{
+		{name: "chunk_1.chunk", want: 1},
+		{name: "chunk_2.chunk", want: 2},
+		{name: "chunk_10.chunk", want: 10},
+		{name: "/uploads/42/chunk_007.chunk", want: 7},
+		{name: "video_2023_5.chunk", want: 5},
+		{name: "video_2023_5.chunk", strategy: ChunkIndexFirst, want: 2023},
+		{name: "stray.chunk", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+string(tt.strategy), func(t *testing.T) {
+			vc, _ := newTestConverter(t, ConversionOptions{ChunkIndex: tt.strategy})
+			got, err := vc.extractNumber(tt.name)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidInput) || !strings.Contains(err.Error(), tt.name) {
+					t.Errorf("extractNumber(%q) error = %v, want ErrInvalidInput naming the file", tt.name, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("extractNumber(%q) = %d, %v, want %d", tt.name, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"chunk_2", "chunk_10", true},
+		{"chunk_10", "chunk_2", false},
+		{"chunk_1", "chunk_1", false},
+		{"chunk_02", "chunk_10", true},
+		{"video_2_chunk_9", "video_2_chunk_10", true},
+		{"video_2_chunk_10", "video_10_chunk_1", true},
+		{"video_10_chunk_1", "video_2_chunk_10", false},
+		{"a_1", "b_0", true},
+		{"chunk", "chunk_1", true},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestOrderChunks(t *testing.T) {
+	tests := []struct {
+		index ChunkIndex
+		files []string
+		want  []string
+	}{
+		{
+			files: []string{"chunk_10.chunk", "chunk_2.chunk", "chunk_1.chunk"},
+			want:  []string{"chunk_1.chunk", "chunk_2.chunk", "chunk_10.chunk"},
+		},
+		{
+			files: []string{"video_2_chunk_10.chunk", "video_2_chunk_9.chunk", "video_2_chunk_1.chunk"},
+			want:  []string{"video_2_chunk_1.chunk", "video_2_chunk_9.chunk", "video_2_chunk_10.chunk"},
+		},
+		{
+			files: []string{"part_a_1.chunk", "part_b_0.chunk"},
+			want:  []string{"part_b_0.chunk", "part_a_1.chunk"},
+		},
+		{
+			index: ChunkIndexFirst,
+			files: []string{"1_video_7.chunk", "0_video_9.chunk", "2_video_8.chunk"},
+			want:  []string{"0_video_9.chunk", "1_video_7.chunk", "2_video_8.chunk"},
+		},
+		{
+			files: []string{"b_1.chunk", "a_1.chunk"},
+			want:  []string{"a_1.chunk", "b_1.chunk"},
+		},
+	}
+	for _, tt := range tests {
+		vc, _ := newTestConverter(t, ConversionOptions{ChunkIndex: tt.index})
+		chunks, err := vc.orderChunks(tt.files)
+		if err != nil {
+			t.Fatalf("orderChunks(%q): %v", tt.files, err)
+		}
+		got := make([]string, len(chunks))
+		for i, chunk := range chunks {
+			got[i] = chunk.path
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orderChunks(%q) = %q, want %q", tt.files, got, tt.want)
+		}
+	}
+}
+
+func TestSequenceErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		indices []int
+		start   int
+		want    []string
+	}{
+		{name: "clean from zero", indices: []int{0, 1, 2}},
+		{name: "clean from one", indices: []int{1, 2, 3}, start: 1},
+		{name: "gap in the middle", indices: []int{0, 1, 3}, want: []string{"missing chunk 2"}},
+		{name: "several gaps", indices: []int{0, 3, 5}, want: []string{"missing chunks 1, 2, 4"}},
+		{name: "missing first chunk", indices: []int{1, 2}, want: []string{"missing chunk 0"}},
+		{name: "missing first chunk from one", indices: []int{2, 3}, start: 1, want: []string{"missing chunk 1"}},
+		{name: "before first chunk", indices: []int{0, 1, 2}, start: 1, want: []string{"unexpected chunk 0 before first chunk 1"}},
+		{name: "duplicate", indices: []int{0, 1, 1}, want: []string{"duplicate chunk 1"}},
+		{name: "out of order", indices: []int{0, 2, 1}, want: []string{"chunk 1 out of order after chunk 2", "missing chunk 1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, err := range sequenceErrors(tt.indices, tt.start) {
+				got = append(got, err.Error())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("sequenceErrors(%v, %d) = %q, want %q", tt.indices, tt.start, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeChunks(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ConversionOptions
+		chunks  []string
+		// want is the merged content, or wantErr part of the error.
+		want    string
+		wantErr string
+	}{
+		{
+			name:   "numeric order",
+			chunks: []string{"chunk_10.chunk", "chunk_2.chunk", "chunk_0.chunk", "chunk_1.chunk", "chunk_3.chunk", "chunk_4.chunk", "chunk_5.chunk", "chunk_6.chunk", "chunk_7.chunk", "chunk_8.chunk", "chunk_9.chunk"},
+			want:   "chunk_0.chunkchunk_1.chunkchunk_2.chunkchunk_3.chunkchunk_4.chunkchunk_5.chunkchunk_6.chunkchunk_7.chunkchunk_8.chunkchunk_9.chunkchunk_10.chunk",
+		},
+		{
+			name:    "missing chunk",
+			chunks:  []string{"chunk_0.chunk", "chunk_1.chunk", "chunk_3.chunk"},
+			wantErr: "missing chunk 2",
+		},
+		{
+			name:    "stray chunk without a number",
+			chunks:  []string{"chunk_0.chunk", "stray.chunk"},
+			wantErr: "chunk stray.chunk has no numeric index",
+		},
+		{
+			name:    "custom pattern",
+			options: ConversionOptions{ChunkPattern: "part-*.bin", FirstChunkIndex: 1},
+			chunks:  []string{"part-2.bin", "part-1.bin", "notes.txt", "chunk_0.chunk"},
+			want:    "part-1.binpart-2.bin",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc, _ := newTestConverter(t, tt.options)
+			dir := t.TempDir()
+			writeChunks(t, dir, tt.chunks...)
+			output := filepath.Join(t.TempDir(), "merged.mp4")
+
+			_, merged, err := vc.mergeChunks(context.Background(), &VideoTask{VideoID: 1, Path: dir}, output)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("mergeChunks error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mergeChunks: %v", err)
+			}
+			content, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("merged %q, want %q", content, tt.want)
+			}
+			if len(merged) != len(chunksIn(t, dir, vc.options.ChunkPattern)) {
+				t.Errorf("merged chunks = %q", merged)
+			}
+		})
+	}
+}
+
+func chunksIn(t *testing.T, dir, pattern string) []string {
+	t.Helper()
+	chunks, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+// remoteStorage is local storage the converter does not recognize as such,
+// so it converts in a work directory as it does for object storage.
+type remoteStorage struct {
+	*storage.Local
+}
+
+// interruptingConverter returns a converter whose merges are cancelled once
+// interruptAt bytes were written, reporting the progress of every merge.
+func interruptingConverter(t *testing.T, options ConversionOptions, interruptAt int64) (vc *VideoConverter, ctx context.Context, progress func() []int64) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	var (
+		mu      sync.Mutex
+		written []int64
+	)
+	options.OnMergeProgress = func(_ int, n int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, n)
+		if n >= interruptAt {
+			cancel()
+		}
+	}
+	vc, _ = newTestConverter(t, options)
+	return vc, ctx, func() []int64 {
+		mu.Lock()
+		defer mu.Unlock()
+		reported := written
+		written = nil
+		return reported
+	}
+}
+
+func TestMergeResumesAfterInterruption(t *testing.T) {
+	// Every chunk holds its 13 byte name.
+	vc, ctx, progress := interruptingConverter(t, ConversionOptions{}, 26)
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk", "chunk_2.chunk", "chunk_3.chunk")
+	output := filepath.Join(t.TempDir(), "merged.mp4")
+	task := &VideoTask{VideoID: 1, Path: dir}
+
+	if _, _, err := vc.mergeChunks(ctx, task, output); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted mergeChunks error = %v, want context.Canceled", err)
+	}
+	if got := progress(); !reflect.DeepEqual(got, []int64{13, 26}) {
+		t.Fatalf("progress before the interruption = %v", got)
+	}
+	if _, err := os.Stat(output + mergeStateSuffix); err != nil {
+		t.Fatalf("merge state was not kept: %v", err)
+	}
+
+	written, _, err := vc.mergeChunks(context.Background(), task, output)
+	if err != nil {
+		t.Fatalf("resumed mergeChunks: %v", err)
+	}
+	if got := progress(); !reflect.DeepEqual(got, []int64{39, 52}) {
+		t.Errorf("progress after resuming = %v, want only the last two chunks", got)
+	}
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "chunk_0.chunkchunk_1.chunkchunk_2.chunkchunk_3.chunk"; string(content) != want || written != int64(len(want)) {
+		t.Errorf("merged %d bytes %q, want %q", written, content, want)
+	}
+	if _, err := os.Stat(output + mergeStateSuffix); !os.IsNotExist(err) {
+		t.Errorf("merge state kept after a complete merge: %v", err)
+	}
+}
+
+func TestMergeIgnoresCorruptState(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+	}{
+		{name: "not json", state: `{"chunks": 2,`},
+		{name: "other chunks", state: `{"chunks":2,"last_index":7,"offset":26}`},
+		{name: "more chunks than exist", state: `{"chunks":5,"last_index":4,"offset":65}`},
+		{name: "offset past the merged file", state: `{"chunks":2,"last_index":1,"offset":4096}`},
+		{name: "negative offset", state: `{"chunks":2,"last_index":1,"offset":-1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc, _, progress := interruptingConverter(t, ConversionOptions{}, math.MaxInt64)
+			dir := t.TempDir()
+			writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk", "chunk_2.chunk")
+			output := filepath.Join(t.TempDir(), "merged.mp4")
+			if err := os.WriteFile(output, bytes.Repeat([]byte("x"), 100), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(output+mergeStateSuffix, []byte(tt.state), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := vc.mergeChunks(context.Background(), &VideoTask{VideoID: 1, Path: dir}, output); err != nil {
+				t.Fatalf("mergeChunks: %v", err)
+			}
+			if got := progress(); !reflect.DeepEqual(got, []int64{13, 26, 39}) {
+				t.Errorf("progress = %v, want the merge to start over", got)
+			}
+			content, err := os.ReadFile(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "chunk_0.chunkchunk_1.chunkchunk_2.chunk"; string(content) != want {
+				t.Errorf("merged %q, want %q", content, want)
+			}
+		})
+	}
+}
+
+func TestInterruptedMergeResumedInWorkDir(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	vc, ctx, progress := interruptingConverter(t, ConversionOptions{Storage: remoteStorage{storage.NewLocal()}}, 13)
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk", "chunk_2.chunk")
+	task := &VideoTask{VideoID: 1, Path: dir}
+	workDir := filepath.Join(os.TempDir(), "video-1")
+
+	if _, err := vc.processVideo(ctx, task); !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted processVideo error = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "merged.mp4"+mergeStateSuffix)); err != nil {
+		t.Fatalf("interrupted merge was not kept in the work dir: %v", err)
+	}
+	progress()
+
+	if _, err := vc.processVideo(context.Background(), task); err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	if got := progress(); !reflect.DeepEqual(got, []int64{26, 39}) {
+		t.Errorf("progress after the retry = %v, want the merge resumed", got)
+	}
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Errorf("work dir kept after a successful conversion: %v", err)
+	}
+}
+
+func TestMergeRejectsEmptyOutput(t *testing.T) {
+	tests := []struct {
+		name          string
+		minMergedSize int64
+		content       string
+	}{
+		{name: "empty chunks", content: ""},
+		{name: "below MinMergedSize", minMergedSize: 1024, content: "tiny"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc, _ := newTestConverter(t, ConversionOptions{MinMergedSize: tt.minMergedSize})
+			dir := t.TempDir()
+			for _, name := range []string{"chunk_0.chunk", "chunk_1.chunk"} {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir})
+			if !errors.Is(err, ErrEmptyMerge) || !errors.Is(err, ErrMerge) {
+				t.Fatalf("processVideo error = %v, want ErrEmptyMerge in the merge stage", err)
+			}
+			if calls := vc.options.Runner.(*stubRunner).calls; len(calls) != 0 {
+				t.Errorf("commands ran on an empty merge: %q", calls)
+			}
+		})
+	}
+}
+
+func TestMergeWithoutChunks(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{})
+	dir := t.TempDir()
+	writeChunks(t, dir, "notes.txt")
+
+	_, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir})
+	if !errors.Is(err, ErrNoChunks) || errors.Is(err, ErrEmptyMerge) {
+		t.Fatalf("processVideo error = %v, want ErrNoChunks rather than an empty merge", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "merged.mp4")); !os.IsNotExist(err) {
+		t.Errorf("merged file left behind: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package converter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const metadataFile = "metadata.json"
+
+// Metadata is written next to the output so consumers do not need to probe
+// the video again.
+type Metadata struct {
+	VideoID     int         `json:"video_id"`
+	Duration    float64     `json:"duration"`
+	Width       int         `json:"width"`
+	Height      int         `json:"height"`
+	VideoCodec  string      `json:"video_codec"`
+	AudioCodec  string      `json:"audio_codec,omitempty"`
+	Renditions  []Rendition `json:"renditions"`
+	ConvertedAt time.Time   `json:"converted_at"`
+}
+
+// writeMetadata writes the metadata of the converted video into workDir.
+func (vc *VideoConverter) writeMetadata(task *VideoTask, workDir string, media *MediaInfo) (string, error) {
+	renditions := vc.options.Renditions
+	if renditions == nil {
+		renditions = []Rendition{}
+	}
+	data, err := json.MarshalIndent(Metadata{
+		VideoID:     task.VideoID,
+		Duration:    media.Duration.Seconds(),
+		Width:       media.Width,
+		Height:      media.Height,
+		VideoCodec:  media.VideoCodec,
+		AudioCodec:  media.AudioCodec,
+		Renditions:  renditions,
+		ConvertedAt: time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(workDir, metadataFile)
+	if err := os.WriteFile(file, data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %v", metadataFile, err)
+	}
+	return file, nil
+}
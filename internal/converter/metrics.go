@@ -0,0 +1,102 @@
+package converter
+
+import (
+	"errors"
+	"time"
+)
+
+type Stage string
+
+const (
+	StageUnmarshal Stage = "unmarshal"
+	StageMerge     Stage = "merge"
+	StageFFmpeg    Stage = "ffmpeg"
+	StageDB        Stage = "db"
+	StagePublish   Stage = "publish"
+	// StageStorage covers the work and output directories and the uploads of
+	// the output.
+	StageStorage Stage = "storage"
+	// StagePanic is only reported to Metrics, for a handler that panicked.
+	StagePanic Stage = "panic"
+)
+
+// Metrics receives the outcome of every task handled by the converter. Each
+// processed task ends in exactly one TaskSucceeded, TaskFailed or TaskRequeued
+// call.
+type Metrics interface {
+	TaskProcessed()
+	TaskSucceeded()
+	TaskFailed(stage Stage)
+	// TaskRequeued is called for a task put back in the queue before it
+	// started, with reason "locked" while another worker converts the same
+	// video or "low_disk" while the output volume is short of space.
+	TaskRequeued(reason string)
+	ObserveProcessDuration(d time.Duration)
+	ObserveFFmpegDuration(d time.Duration)
+	ObserveMergedSize(bytes int64)
+	// ConversionStarted and ConversionFinished bracket every processVideo run.
+	ConversionStarted()
+	ConversionFinished()
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) TaskProcessed()                       {}
+func (noopMetrics) TaskSucceeded()                       {}
+func (noopMetrics) TaskFailed(Stage)                     {}
+func (noopMetrics) TaskRequeued(string)                  {}
+func (noopMetrics) ObserveProcessDuration(time.Duration) {}
+func (noopMetrics) ObserveFFmpegDuration(time.Duration)  {}
+func (noopMetrics) ObserveMergedSize(int64)              {}
+func (noopMetrics) ConversionStarted()                   {}
+func (noopMetrics) ConversionFinished()                  {}
+
+// Errors returned by a failed stage match the sentinel of that stage with
+// errors.Is, and a *StageError with errors.As.
+var (
+	ErrUnmarshal = errors.New("unmarshal failed")
+	ErrMerge     = errors.New("merge failed")
+	ErrFFmpeg    = errors.New("ffmpeg failed")
+	ErrDatabase  = errors.New("database failed")
+	ErrPublish   = errors.New("publish failed")
+	ErrStorage   = errors.New("storage failed")
+)
+
+var stageErrors = map[Stage]error{
+	StageUnmarshal: ErrUnmarshal,
+	StageMerge:     ErrMerge,
+	StageFFmpeg:    ErrFFmpeg,
+	StageDB:        ErrDatabase,
+	StagePublish:   ErrPublish,
+	StageStorage:   ErrStorage,
+}
+
+// StageError records the stage in which Err happened.
+type StageError struct {
+	Stage Stage
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+func (e *StageError) Is(target error) bool {
+	return stageErrors[e.Stage] == target
+}
+
+func withStage(stage Stage, err error) error {
+	return &StageError{Stage: stage, Err: err}
+}
+
+func failureStage(err error, fallback Stage) Stage {
+	var se *StageError
+	if errors.As(err, &se) {
+		return se.Stage
+	}
+	return fallback
+}
@@ -0,0 +1,336 @@
+package converter
+
+import (
+	"fmt"
+	"imersaofc/internal/storage"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultSegmentDuration = 4 * time.Second
+	defaultFFmpegPath      = "ffmpeg"
+	defaultFFprobePath     = "ffprobe"
+	defaultMaxRetries      = 3
+	defaultRetryBackoff    = 5 * time.Second
+	defaultProcessBackoff  = time.Second
+	defaultProcessMaxDelay = 30 * time.Second
+	defaultMergeBufferSize = 1 << 20
+	defaultChunkPattern    = "*.chunk"
+	defaultDiskMultiplier  = 3
+	defaultDBTimeout       = 5 * time.Second
+	defaultLockRetryDelay  = 5 * time.Second
+)
+
+type OutputFormat string
+
+const (
+	FormatDASH OutputFormat = "dash"
+	FormatHLS  OutputFormat = "hls"
+	FormatBoth OutputFormat = "both"
+)
+
+func (f OutputFormat) formats() ([]OutputFormat, error) {
+	switch f {
+	case FormatDASH, FormatHLS:
+		return []OutputFormat{f}, nil
+	case FormatBoth:
+		return []OutputFormat{FormatDASH, FormatHLS}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", f)
+	}
+}
+
+// ChunkIndex selects which group of digits in a chunk file name holds its
+// position, so "video_2023_5.chunk" can be ordered by 5 rather than 2023.
+type ChunkIndex string
+
+const (
+	ChunkIndexLast  ChunkIndex = "last"
+	ChunkIndexFirst ChunkIndex = "first"
+)
+
+// Rendition describes one step of the adaptive bitrate ladder. Bitrates are
+// expressed in kbps.
+type Rendition struct {
+	Width        int `json:"width"`
+	Height       int `json:"height"`
+	VideoBitrate int `json:"video_bitrate"`
+	AudioBitrate int `json:"audio_bitrate"`
+}
+
+type ConversionOptions struct {
+	// FFmpegPath and FFprobePath are the binaries to run, looked up in PATH
+	// unless they are paths. Default to ffmpeg and ffprobe.
+	FFmpegPath  string
+	FFprobePath string
+	// SegmentDuration is the target duration of the DASH and HLS segments.
+	// Defaults to 4s.
+	SegmentDuration time.Duration
+	// FragmentDuration, when set, splits the DASH segments into fragments of
+	// that duration.
+	FragmentDuration time.Duration
+	// OutputFormat is the format of tasks that do not set one. Defaults to
+	// FormatDASH.
+	OutputFormat OutputFormat
+	// Renditions is the bitrate ladder, encoded in this order. Without
+	// renditions the input resolution is kept.
+	Renditions []Rendition
+	// Accel selects the hardware encoder; ffmpeg must have been built with
+	// it. AccelVAAPI supports neither renditions nor burned subtitles.
+	// Defaults to AccelNone, which encodes with x264.
+	Accel Accel
+	// AudioMode copies, re-encodes or drops the audio. Defaults to AudioCopy.
+	AudioMode AudioMode
+	// NormalizeLoudness runs a loudnorm analysis pass and normalizes the audio
+	// to TargetLoudness in the conversion. It requires AudioAAC.
+	NormalizeLoudness bool
+	// TargetLoudness is the integrated loudness in LUFS. Defaults to -16.
+	TargetLoudness float64
+	// ParallelRenditions, when above one, encodes up to that many renditions
+	// in separate ffmpeg processes at once and then packages them into a
+	// single manifest.
+	ParallelRenditions int
+	// Packaging selects the DASH packaging. Defaults to PackagingDefault.
+	Packaging Packaging
+	// DASHContainer, when set, overrides the dash muxer settings of Packaging.
+	DASHContainer *DASHContainer
+	// PathResolver maps a task to the directory of its chunks. Defaults to
+	// VideoTask.Path.
+	PathResolver PathResolver
+	// AllowedRoot, when set, rejects tasks whose resolved path or subtitle
+	// file is outside of it, symlinks included.
+	AllowedRoot string
+	// ManifestName is the manifest file name; HLS uses the same name with the
+	// .m3u8 extension. {video_id} is replaced with the video id. Defaults to
+	// output.mpd.
+	ManifestName string
+	// SubtitleMode selects how VideoTask.SubtitlePath reaches the output.
+	// Defaults to SubtitleNone.
+	SubtitleMode SubtitleMode
+	// Converter replaces the local ffmpeg conversion, e.g. with a remote
+	// transcoding service. The ffmpeg settings are ignored when it is set.
+	Converter Converter
+
+	// OwnResources makes Close and Shutdown close the database and the
+	// RabbitMQ client passed to NewVideoConverter.
+	OwnResources bool
+	// KeyProvider, when set, encrypts HLS segments with AES-128. The key URI
+	// it returns is written into the playlists.
+	KeyProvider KeyProvider
+	// FFmpegExtraArgs are passed to ffmpeg right before each output. They
+	// must not contain inputs or output paths.
+	FFmpegExtraArgs []string
+	// FFmpegOutputLimit is how many trailing bytes of ffmpeg's output are
+	// kept for the error log. Defaults to 4KB.
+	FFmpegOutputLimit int
+	// Runner executes ffmpeg and ffprobe. Defaults to running the local
+	// binaries; the binaries are not checked at startup when it is set.
+	Runner Runner
+	// KeepFFmpegLog keeps ffmpeg.log in the output after a successful
+	// conversion. It is always kept when ffmpeg fails.
+	KeepFFmpegLog bool
+
+	// MaxConcurrentFFmpeg bounds how many ffmpeg processes run at once,
+	// independently of how many tasks are consumed: every rendition encoded
+	// in parallel and every thumbnail, sprite or subtitle pass takes a slot.
+	// Zero means no limit.
+	MaxConcurrentFFmpeg int
+
+	// TaskTimeout bounds the whole processing of a task. Zero disables it.
+	TaskTimeout time.Duration
+	// DBTimeout bounds every database call. A call that times out requeues
+	// the task. Defaults to 5s.
+	DBTimeout time.Duration
+	// LockRetryDelay is how long a task whose video another worker is
+	// converting is held before it is requeued. Defaults to 5s.
+	LockRetryDelay time.Duration
+	// ConversionTimeout bounds the ffmpeg run alone; ffmpeg is killed once it
+	// expires and the task is retried. Zero disables it, see
+	// DefaultConversionTimeout for a sensible value.
+	ConversionTimeout time.Duration
+
+	// MaxRetries is how many times a failed task is republished before it
+	// is dead-lettered. Defaults to 3.
+	MaxRetries int
+	// RetryBackoff is the delay before the first republish, doubled on every
+	// retry. The broker holds the task meanwhile. Defaults to 5s.
+	RetryBackoff time.Duration
+	// ProcessRetry retries transient conversion failures within the same
+	// delivery, before falling back to MaxRetries.
+	ProcessRetry RetryPolicy
+
+	// Metrics receives the outcome of every task. Defaults to discarding
+	// them.
+	Metrics Metrics
+	// TracerProvider creates the spans of every task. Defaults to the global
+	// provider, which is a no-op until the application installs one.
+	TracerProvider trace.TracerProvider
+
+	// GenerateThumbnail writes a thumbnail.jpg next to the output, taken at
+	// ThumbnailAt.
+	GenerateThumbnail bool
+	// ThumbnailAt is the position of the thumbnail frame. Defaults to 1s.
+	ThumbnailAt time.Duration
+
+	// SpriteInterval, when set, extracts a frame at that interval into sprite
+	// sheets with a thumbnails.vtt for scrubbing previews.
+	SpriteInterval time.Duration
+
+	// RemoveChunksAfterMerge removes the chunks that were merged once the
+	// conversion has been confirmed downstream. Chunks are always kept when a
+	// task fails, and when a custom Converter is used. LoadConfig enables it
+	// unless REMOVE_CHUNKS_AFTER_MERGE is false.
+	RemoveChunksAfterMerge bool
+
+	// DiskSpaceMultiplier is applied to the total chunk size to estimate the
+	// space a conversion needs: the merged file plus the converted output.
+	// Defaults to 3.
+	DiskSpaceMultiplier float64
+
+	// KeepFailedArtifacts leaves the merged file and partial output of a
+	// failed task on disk for debugging. By default they are removed.
+	KeepFailedArtifacts bool
+
+	// Storage holds the task chunks and receives the converted output.
+	// Defaults to the local filesystem.
+	Storage storage.Storage
+	// OutputBaseDir, when set, receives the output under
+	// OutputBaseDir/<video id> instead of next to the chunks in the task path.
+	OutputBaseDir string
+
+	// Uploader, when set, uploads the converted output under
+	// UploadPrefix/<video id>, and the confirmation carries that location
+	// instead of the task path.
+	Uploader Uploader
+	// UploadPrefix is prepended to the uploaded object keys.
+	UploadPrefix string
+	// RemoveAfterUpload deletes the local output once it was uploaded.
+	RemoveAfterUpload bool
+
+	// CompletionWebhook, when set, receives a POST with a WebhookPayload once
+	// a video is marked as processed. Failures never fail the task.
+	CompletionWebhook string
+
+	// MergeBufferSize is the size of the buffer used to copy chunks into the
+	// merged file. Defaults to 1 MiB.
+	MergeBufferSize int
+	// MinFreeBytes, when set, requeues tasks after a short delay instead of
+	// starting them while the output volume has less free space.
+	MinFreeBytes uint64
+	// JanitorDryRun makes StartJanitor log the outputs it would remove
+	// without removing them.
+	JanitorDryRun bool
+	// MinMergedSize is the smallest merged file accepted, in bytes. Smaller
+	// files fail with ErrEmptyMerge. Defaults to 1.
+	MinMergedSize int64
+	// ChunkPattern is the glob matched against chunk file names. Defaults to
+	// "*.chunk".
+	ChunkPattern string
+	// ChunkIndex picks the digit group used to order chunks. Defaults to the
+	// last one.
+	ChunkIndex ChunkIndex
+	// FirstChunkIndex is the index the chunk sequence must start from.
+	FirstChunkIndex int
+	// OnMergeProgress, when set, is called after each chunk with the total
+	// bytes merged so far.
+	OnMergeProgress func(videoID int, bytesWritten int64)
+
+	// OnProgress, when set, is called at most once per second with the
+	// conversion progress of a video.
+	OnProgress func(videoID int, percent float64)
+
+	// ConfirmationBuilder replaces the JSON ConfirmationMessage payload.
+	ConfirmationBuilder ConfirmationBuilder
+
+	// Hooks are called at fixed points of every task. Every hook is
+	// optional.
+	Hooks Hooks
+}
+
+func (o ConversionOptions) withDefaults() ConversionOptions {
+	if o.FFmpegPath == "" {
+		o.FFmpegPath = defaultFFmpegPath
+	}
+	if o.FFprobePath == "" {
+		o.FFprobePath = defaultFFprobePath
+	}
+	if o.SegmentDuration == 0 {
+		o.SegmentDuration = defaultSegmentDuration
+	}
+	if o.OutputFormat == "" {
+		o.OutputFormat = FormatDASH
+	}
+	if o.Accel == "" {
+		o.Accel = AccelNone
+	}
+	if o.AudioMode == "" {
+		o.AudioMode = AudioCopy
+	}
+	if o.Packaging == "" {
+		o.Packaging = PackagingDefault
+	}
+	if o.ManifestName == "" {
+		o.ManifestName = defaultManifestName
+	}
+	if o.SubtitleMode == "" {
+		o.SubtitleMode = SubtitleNone
+	}
+	if o.TargetLoudness == 0 {
+		o.TargetLoudness = defaultTargetLoudness
+	}
+	if o.Runner == nil {
+		o.Runner = execRunner{}
+	}
+	if o.FFmpegOutputLimit <= 0 {
+		o.FFmpegOutputLimit = defaultFFmpegOutputLimit
+	}
+	if o.DBTimeout <= 0 {
+		o.DBTimeout = defaultDBTimeout
+	}
+	if o.LockRetryDelay <= 0 {
+		o.LockRetryDelay = defaultLockRetryDelay
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = defaultMaxRetries
+	}
+	if o.RetryBackoff == 0 {
+		o.RetryBackoff = defaultRetryBackoff
+	}
+	if o.ProcessRetry.InitialBackoff == 0 {
+		o.ProcessRetry.InitialBackoff = defaultProcessBackoff
+	}
+	if o.ProcessRetry.MaxBackoff == 0 {
+		o.ProcessRetry.MaxBackoff = defaultProcessMaxDelay
+	}
+	if o.ThumbnailAt == 0 {
+		o.ThumbnailAt = defaultThumbnailAt
+	}
+	if o.MinMergedSize <= 0 {
+		o.MinMergedSize = 1
+	}
+	if o.MergeBufferSize <= 0 {
+		o.MergeBufferSize = defaultMergeBufferSize
+	}
+	if o.DiskSpaceMultiplier <= 0 {
+		o.DiskSpaceMultiplier = defaultDiskMultiplier
+	}
+	if o.ChunkPattern == "" {
+		o.ChunkPattern = defaultChunkPattern
+	}
+	if o.ChunkIndex == "" {
+		o.ChunkIndex = ChunkIndexLast
+	}
+	if o.TracerProvider == nil {
+		o.TracerProvider = otel.GetTracerProvider()
+	}
+	if o.Metrics == nil {
+		o.Metrics = noopMetrics{}
+	}
+	if o.Storage == nil {
+		o.Storage = storage.NewLocal()
+	}
+	return o
+}
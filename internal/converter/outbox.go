@@ -0,0 +1,161 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"imersaofc/internal/rabbitmq"
+	"log/slog"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultOutboxInterval = time.Second
+	outboxBatchSize       = 100
+	jsonContentType       = "application/json"
+)
+
+type OutboxMessage struct {
+	Exchange   string
+	RoutingKey string
+	Queue      string
+	// Payload is published as is with ContentType, which defaults to JSON.
+	Payload     []byte
+	ContentType string
+	// Headers are published as AMQP headers, carrying the trace context.
+	Headers       map[string]string
+	CorrelationID string
+}
+
+// EnqueueOutbox stores a message that the OutboxPublisher delivers once tx
+// commits.
+func EnqueueOutbox(ctx context.Context, tx *sql.Tx, message OutboxMessage) error {
+	return insertOutbox(ctx, tx, message)
+}
+
+func insertOutbox(ctx context.Context, db execer, message OutboxMessage) error {
+	headers, err := json.Marshal(message.Headers)
+	if err != nil {
+		return err
+	}
+	contentType := message.ContentType
+	if contentType == "" {
+		contentType = jsonContentType
+	}
+	query := "insert into outbox (exchange, routing_key, queue, payload, content_type, headers, correlation_id, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8)"
+	_, err = db.ExecContext(ctx, query, message.Exchange, message.RoutingKey, message.Queue, message.Payload, contentType, headers, message.CorrelationID, time.Now())
+	return err
+}
+
+// OutboxPublisher publishes the messages stored in the outbox table and marks
+// them as published once the broker confirmed them.
+type OutboxPublisher struct {
+	db             *sql.DB
+	rabbitmqClient broker
+	interval       time.Duration
+	tracer         trace.Tracer
+}
+
+// NewOutboxPublisher returns a publisher draining the outbox every interval.
+// A nil tracerProvider defaults to the global one.
+func NewOutboxPublisher(db *sql.DB, rabbitmqClient *rabbitmq.RabbitClient, interval time.Duration, tracerProvider trace.TracerProvider) *OutboxPublisher {
+	if interval <= 0 {
+		interval = defaultOutboxInterval
+	}
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	return &OutboxPublisher{
+		db:             db,
+		rabbitmqClient: rabbitmqClient,
+		interval:       interval,
+		tracer:         tracerProvider.Tracer(tracerName),
+	}
+}
+
+// Run drains the outbox every interval until ctx is cancelled.
+func (p *OutboxPublisher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		if err := p.drain(ctx); err != nil {
+			slog.Error("Failed to drain outbox", slog.String("error", err.Error()))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *OutboxPublisher) drain(ctx context.Context) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "select id, exchange, routing_key, queue, payload, content_type, headers, correlation_id from outbox where published_at is null order by id limit $1 for update skip locked", outboxBatchSize)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id      int64
+		message OutboxMessage
+	}
+	var messages []pending
+	for rows.Next() {
+		var m pending
+		var headers []byte
+		var correlationID sql.NullString
+		if err := rows.Scan(&m.id, &m.message.Exchange, &m.message.RoutingKey, &m.message.Queue, &m.message.Payload, &m.message.ContentType, &headers, &correlationID); err != nil {
+			rows.Close()
+			return err
+		}
+		if len(headers) > 0 {
+			json.Unmarshal(headers, &m.message.Headers)
+		}
+		m.message.CorrelationID = correlationID.String
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, m := range messages {
+		err := p.publish(ctx, m.message)
+		if err != nil {
+			slog.Error("Failed to publish outbox message", slog.Int64("id", m.id), slog.String("error", err.Error()))
+			break
+		}
+		_, err = tx.ExecContext(ctx, "update outbox set published_at = $1 where id = $2", time.Now(), m.id)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// publish sends the message in a span that continues the trace of the task
+// that produced it.
+func (p *OutboxPublisher) publish(ctx context.Context, message OutboxMessage) error {
+	ctx = propagator.Extract(ctx, propagation.MapCarrier(message.Headers))
+	ctx, span := p.tracer.Start(ctx, "outbox.publish", trace.WithSpanKind(trace.SpanKindProducer))
+	headers := amqp.Table{}
+	propagator.Inject(ctx, amqpCarrier(headers))
+	err := p.rabbitmqClient.PublishToQueue(message.Exchange, message.RoutingKey, message.Queue, amqp.Publishing{
+		ContentType:   message.ContentType,
+		Headers:       headers,
+		CorrelationId: message.CorrelationID,
+		Body:          message.Payload,
+	})
+	endSpan(span, err)
+	return err
+}
@@ -0,0 +1,126 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestOutboxKeepsMessageWhenPublishFails(t *testing.T) {
+	fake, db := newFakeDB(t)
+	logs := captureLogs(t)
+	ctx := context.Background()
+	marked, err := MarkProcessedWithOutbox(ctx, db, 1, OutboxMessage{
+		Exchange:   "amq.direct",
+		RoutingKey: "confirmation",
+		Queue:      "confirmations",
+		Payload:    []byte(`{"video_id":1}`),
+	})
+	if err != nil || !marked {
+		t.Fatalf("MarkProcessedWithOutbox = %v, %v", marked, err)
+	}
+
+	broker := &fakeBroker{err: errors.New("channel closed")}
+	publisher := NewOutboxPublisher(db, nil, 0, nil)
+	publisher.rabbitmqClient = broker
+	if err := publisher.drain(ctx); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if rows := fake.outboxRows(); len(rows) != 1 || rows[0].published {
+		t.Fatalf("outbox = %+v, want the message still pending", rows)
+	}
+	if !strings.Contains(logs.String(), "Failed to publish outbox message") || !strings.Contains(logs.String(), "channel closed") {
+		t.Errorf("publish failure was not logged:\n%s", logs)
+	}
+
+	broker.setErr(nil)
+	if err := publisher.drain(ctx); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if rows := fake.outboxRows(); !rows[0].published {
+		t.Error("message was not marked as published after a successful publish")
+	}
+	published := broker.messages()
+	if len(published) != 1 || string(published[0].msg.Body) != `{"video_id":1}` || published[0].queue != "confirmations" {
+		t.Errorf("published = %+v", published)
+	}
+}
+
+// spanRecorder is a TracerProvider recording the names of the spans started.
+type spanRecorder struct {
+	noop.TracerProvider
+	mu    sync.Mutex
+	spans []string
+}
+
+func (r *spanRecorder) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{recorder: r}
+}
+
+type recordingTracer struct {
+	noop.Tracer
+	recorder *spanRecorder
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	t.recorder.mu.Lock()
+	t.recorder.spans = append(t.recorder.spans, name)
+	t.recorder.mu.Unlock()
+	return t.Tracer.Start(ctx, name, opts...)
+}
+
+func TestOutboxPublisherUsesTracerProvider(t *testing.T) {
+	_, db := newFakeDB(t)
+	ctx := context.Background()
+	if _, err := MarkProcessedWithOutbox(ctx, db, 1, OutboxMessage{Exchange: "amq.direct", Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &spanRecorder{}
+	publisher := NewOutboxPublisher(db, nil, 0, recorder)
+	publisher.rabbitmqClient = &fakeBroker{}
+	if err := publisher.drain(ctx); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	if len(recorder.spans) != 1 || recorder.spans[0] != "outbox.publish" {
+		t.Errorf("spans = %q, want the publish traced by the given provider", recorder.spans)
+	}
+}
+
+func TestOutboxPublishesBuilderContentType(t *testing.T) {
+	vc, fake := newTestConverter(t, ConversionOptions{
+		ConfirmationBuilder: func(task VideoTask, _ Result) ([]byte, string, error) {
+			return []byte{0x08, byte(task.VideoID), 0xff}, "application/x-protobuf", nil
+		},
+	})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	d, ack := newDelivery(t, VideoTask{VideoID: 3, Path: dir})
+	handle(context.Background(), vc, d)
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Fatalf("delivery was %s, want ack", outcome)
+	}
+	if rows := fake.outboxRows(); len(rows) != 1 || rows[0].message.ContentType != "application/x-protobuf" {
+		t.Fatalf("outbox = %+v, want the builder content type stored", rows)
+	}
+
+	broker := &fakeBroker{}
+	publisher := NewOutboxPublisher(vc.db, nil, 0, nil)
+	publisher.rabbitmqClient = broker
+	if err := publisher.drain(context.Background()); err != nil {
+		t.Fatalf("drain: %v", err)
+	}
+	published := broker.messages()
+	if len(published) != 1 {
+		t.Fatalf("published = %+v, want the confirmation", published)
+	}
+	if msg := published[0].msg; msg.ContentType != "application/x-protobuf" || !bytes.Equal(msg.Body, []byte{0x08, 3, 0xff}) {
+		t.Errorf("published %q with content type %q", msg.Body, msg.ContentType)
+	}
+}
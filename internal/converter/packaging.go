@@ -0,0 +1,76 @@
+package converter
+
+import "fmt"
+
+// Packaging selects how the DASH output is packaged.
+type Packaging string
+
+const (
+	// PackagingDefault leaves the packaging to ffmpeg's dash muxer.
+	PackagingDefault Packaging = "default"
+	// PackagingCMAF writes fragmented MP4 segments addressed by a
+	// SegmentTemplate with a SegmentTimeline.
+	PackagingCMAF Packaging = "cmaf"
+)
+
+// DASHContainer tunes the dash muxer. When set it replaces the defaults of
+// the Packaging.
+type DASHContainer struct {
+	UseTemplate bool
+	UseTimeline bool
+	// SegmentType is mp4, webm or auto.
+	SegmentType string
+	// SingleFile writes every representation into a single file addressed
+	// by byte ranges.
+	SingleFile bool
+}
+
+var cmafContainer = DASHContainer{UseTemplate: true, UseTimeline: true, SegmentType: "mp4"}
+
+func (p Packaging) validate() error {
+	switch p {
+	case PackagingDefault, PackagingCMAF:
+		return nil
+	default:
+		return fmt.Errorf("unsupported packaging %q: must be %s or %s", p, PackagingDefault, PackagingCMAF)
+	}
+}
+
+func (c *DASHContainer) validate() error {
+	switch c.SegmentType {
+	case "mp4", "webm", "auto":
+		return nil
+	default:
+		return fmt.Errorf("unsupported dash segment type %q: must be mp4, webm or auto", c.SegmentType)
+	}
+}
+
+// container returns the dash muxer settings, or nil to keep ffmpeg's.
+func (vc *VideoConverter) container() *DASHContainer {
+	if vc.options.DASHContainer != nil {
+		return vc.options.DASHContainer
+	}
+	if vc.options.Packaging == PackagingCMAF {
+		return &cmafContainer
+	}
+	return nil
+}
+
+func (c *DASHContainer) args() []string {
+	if c == nil {
+		return nil
+	}
+	return []string{
+		"-use_template", boolArg(c.UseTemplate),
+		"-use_timeline", boolArg(c.UseTimeline),
+		"-single_file", boolArg(c.SingleFile),
+		"-dash_segment_type", c.SegmentType,
+	}
+}
+
+func boolArg(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,88 @@
+package converter
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashArgsPackaging(t *testing.T) {
+	tests := []struct {
+		name    string
+		options ConversionOptions
+		want    []string
+	}{
+		{
+			name: "default",
+			want: []string{"-f", "dash", "-seg_duration", "4", "dash/output.mpd"},
+		},
+		{
+			name:    "cmaf",
+			options: ConversionOptions{Packaging: PackagingCMAF},
+			want: []string{
+				"-f", "dash", "-seg_duration", "4",
+				"-use_template", "1", "-use_timeline", "1", "-single_file", "0", "-dash_segment_type", "mp4",
+				"dash/output.mpd",
+			},
+		},
+		{
+			name:    "cmaf with fragments",
+			options: ConversionOptions{Packaging: PackagingCMAF, SegmentDuration: 6 * time.Second, FragmentDuration: 500 * time.Millisecond},
+			want: []string{
+				"-f", "dash", "-seg_duration", "6", "-frag_duration", "0.5",
+				"-use_template", "1", "-use_timeline", "1", "-single_file", "0", "-dash_segment_type", "mp4",
+				"dash/output.mpd",
+			},
+		},
+		{
+			name: "container overrides packaging",
+			options: ConversionOptions{
+				Packaging:     PackagingCMAF,
+				DASHContainer: &DASHContainer{SegmentType: "webm", SingleFile: true},
+			},
+			want: []string{
+				"-f", "dash", "-seg_duration", "4",
+				"-use_template", "0", "-use_timeline", "0", "-single_file", "1", "-dash_segment_type", "webm",
+				"dash/output.mpd",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vc, _ := newTestConverter(t, tt.options)
+			if args := vc.dashArgs("dash", "output"); !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("dashArgs =\n%q\nwant\n%q", args, tt.want)
+			}
+		})
+	}
+}
+
+func TestCMAFReachesFFmpeg(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{Packaging: PackagingCMAF})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	if _, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir}); err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	calls := vc.options.Runner.(*stubRunner).ffmpegCalls()
+	if len(calls) != 1 {
+		t.Fatalf("ffmpeg calls = %q, want the conversion", calls)
+	}
+	if i := slices.Index(calls[0], "-dash_segment_type"); i < 0 || calls[0][i+1] != "mp4" {
+		t.Errorf("ffmpeg calls = %q, want the CMAF segment type", calls)
+	}
+}
+
+func TestInvalidDASHSegmentType(t *testing.T) {
+	_, err := NewVideoConverter(nil, nil, ConversionOptions{
+		Runner:        &stubRunner{},
+		DASHContainer: &DASHContainer{SegmentType: "ts"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "dash segment type") {
+		t.Errorf("NewVideoConverter error = %v, want the ts segment type rejected", err)
+	}
+}
@@ -0,0 +1,109 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+type HandlerFunc func(ctx context.Context, d amqp.Delivery)
+
+// Pool runs deliveries through a fixed number of workers. Submit blocks while
+// every worker is busy and the buffer is full, which bounds the number of
+// concurrent conversions.
+type Pool struct {
+	jobs    chan amqp.Delivery
+	handler HandlerFunc
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+func NewPool(ctx context.Context, workers int, handler HandlerFunc) *Pool {
+	if workers <= 0 {
+		workers = 1
+	}
+	p := &Pool{
+		jobs:    make(chan amqp.Delivery, workers),
+		handler: handler,
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work(ctx)
+	}
+	return p
+}
+
+func (p *Pool) work(ctx context.Context) {
+	defer p.wg.Done()
+	for d := range p.jobs {
+		p.handler(ctx, d)
+	}
+}
+
+func (p *Pool) Submit(d amqp.Delivery) {
+	p.jobs <- d
+}
+
+// Close stops accepting deliveries and waits for queued and in-flight ones to
+// finish.
+func (p *Pool) Close() {
+	p.once.Do(func() {
+		close(p.jobs)
+	})
+	p.wg.Wait()
+}
+
+// Routing names the exchanges, routing keys and queues a ConverterPool
+// consumes from and Handle publishes to.
+type Routing struct {
+	ConversionExchange string
+	ConversionKey      string
+	ConversionQueue    string
+	ConfirmationKey    string
+	ConfirmationQueue  string
+	DeadLetterExchange string
+	DeadLetterKey      string
+	DeadLetterQueue    string
+}
+
+// ConverterPool consumes conversion tasks with a fixed number of workers, each
+// running VideoConverter.Handle. The prefetch matches the worker count so the
+// broker only hands out a delivery when a worker is free.
+type ConverterPool struct {
+	vc      *VideoConverter
+	workers int
+	routing Routing
+}
+
+func NewConverterPool(vc *VideoConverter, workers int, routing Routing) *ConverterPool {
+	if workers <= 0 {
+		workers = 1
+	}
+	return &ConverterPool{vc: vc, workers: workers, routing: routing}
+}
+
+// Run consumes until the delivery channel closes, which happens once
+// VideoConverter.Shutdown stopped the consumer, and then waits for the
+// in-flight conversions to finish.
+func (cp *ConverterPool) Run(ctx context.Context) error {
+	r := cp.routing
+	cp.vc.rabbitmqClient.SetPrefetch(cp.workers)
+	msgs, err := cp.vc.rabbitmqClient.ConsumeMessages(r.ConversionExchange, r.ConversionKey, r.ConversionQueue)
+	if err != nil {
+		return fmt.Errorf("failed to consume messages: %v", err)
+	}
+
+	slog.Info("Converter pool started", slog.Int("workers", cp.workers))
+	pool := NewPool(ctx, cp.workers, func(ctx context.Context, d amqp.Delivery) {
+		cp.vc.Handle(ctx, d, r)
+	})
+	for d := range msgs {
+		pool.Submit(d)
+	}
+	pool.Close()
+	slog.Info("Converter pool drained")
+	return nil
+}
@@ -0,0 +1,93 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrInvalidInput = errors.New("invalid input video")
+
+type MediaInfo struct {
+	Duration   time.Duration
+	VideoCodec string
+	AudioCodec string
+	Width      int
+	Height     int
+	BitRate    int64
+}
+
+func (m MediaInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Duration   float64 `json:"duration"`
+		VideoCodec string  `json:"video_codec"`
+		AudioCodec string  `json:"audio_codec,omitempty"`
+		Width      int     `json:"width"`
+		Height     int     `json:"height"`
+		BitRate    int64   `json:"bit_rate,omitempty"`
+	}{m.Duration.Seconds(), m.VideoCodec, m.AudioCodec, m.Width, m.Height, m.BitRate})
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+}
+
+func (vc *VideoConverter) probeInput(ctx context.Context, path string) (*MediaInfo, error) {
+	output, err := vc.options.Runner.Run(ctx, vc.options.FFprobePath,
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		path,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run ffprobe on %s: %v", path, err)
+	}
+
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	info := &MediaInfo{}
+	if probe.Format.Duration != "" {
+		seconds, err := strconv.ParseFloat(probe.Format.Duration, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse duration %q: %v", probe.Format.Duration, err)
+		}
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	if probe.Format.BitRate != "" {
+		info.BitRate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	}
+	for _, stream := range probe.Streams {
+		switch {
+		case stream.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+		case stream.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = stream.CodecName
+		}
+	}
+
+	if info.VideoCodec == "" {
+		return nil, fmt.Errorf("%w: %s has no video stream", ErrInvalidInput, path)
+	}
+	if info.Duration <= 0 {
+		return nil, fmt.Errorf("%w: %s has zero duration", ErrInvalidInput, path)
+	}
+	return info, nil
+}
@@ -0,0 +1,111 @@
+package converter
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"imersaofc/internal/rabbitmq"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	progressInterval        = time.Second
+	progressStageConverting = "converting"
+)
+
+type ProgressMessage struct {
+	VideoID int     `json:"video_id"`
+	Percent float64 `json:"percent"`
+	Stage   string  `json:"stage"`
+}
+
+// PublishProgress returns an OnProgress callback that publishes a
+// ProgressMessage to exchange with routingKey, declaring and binding queue
+// when it is set. Failures are only logged since progress is best effort.
+func PublishProgress(rabbitmqClient *rabbitmq.RabbitClient, exchange, routingKey, queue string) func(videoID int, percent float64) {
+	return func(videoID int, percent float64) {
+		body, err := json.Marshal(ProgressMessage{VideoID: videoID, Percent: percent, Stage: progressStageConverting})
+		if err != nil {
+			return
+		}
+		if queue != "" {
+			err = rabbitmqClient.PublishMessage(exchange, routingKey, queue, body)
+		} else {
+			err = rabbitmqClient.Publish(exchange, routingKey, amqp.Publishing{
+				ContentType: "application/json",
+				Body:        body,
+			})
+		}
+		if err != nil {
+			slog.Warn("Failed to publish progress", slog.Int("video_id", videoID), slog.String("error", err.Error()))
+		}
+	}
+}
+
+// runFFmpeg runs ffmpeg through the Runner, writing its output to logFile and
+// returning an FFmpegError with the tail of it when it fails. When OnProgress
+// is set, progress is streamed from ffmpeg's stdout and reported against
+// duration.
+func (vc *VideoConverter) runFFmpeg(ctx context.Context, task *VideoTask, args []string, duration time.Duration, logFile string) error {
+	log, err := os.Create(logFile)
+	if err != nil {
+		return fmt.Errorf("failed to create ffmpeg log: %v", err)
+	}
+	defer log.Close()
+	output := &tailBuffer{limit: vc.options.FFmpegOutputLimit}
+	w := io.MultiWriter(output, log)
+	if vc.options.OnProgress == nil || duration <= 0 {
+		combined, err := vc.options.Runner.Run(ctx, vc.options.FFmpegPath, args...)
+		w.Write(combined)
+		return newFFmpegError(err, output, logFile)
+	}
+
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+	progress, stdout := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		vc.readProgress(progress, task.VideoID, duration)
+		// Keep draining so ffmpeg never blocks on a line readProgress gave
+		// up on.
+		io.Copy(io.Discard, progress)
+	}()
+	err = vc.options.Runner.Stream(ctx, stdout, w, vc.options.FFmpegPath, args...)
+	stdout.Close()
+	<-done
+	return newFFmpegError(err, output, logFile)
+}
+
+func (vc *VideoConverter) readProgress(r io.Reader, videoID int, duration time.Duration) {
+	var lastReport time.Time
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "out_time_ms":
+			// Despite its name ffmpeg reports out_time_ms in microseconds.
+			us, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || time.Since(lastReport) < progressInterval {
+				continue
+			}
+			lastReport = time.Now()
+			percent := float64(time.Duration(us)*time.Microsecond) / float64(duration) * 100
+			vc.options.OnProgress(videoID, min(percent, 100))
+		case "progress":
+			if value == "end" {
+				vc.options.OnProgress(videoID, 100)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package converter
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// PrometheusMetrics implements Metrics on its own Prometheus registry.
+type PrometheusMetrics struct {
+	registry        *prometheus.Registry
+	received        prometheus.Counter
+	succeeded       prometheus.Counter
+	failed          *prometheus.CounterVec
+	requeued        *prometheus.CounterVec
+	processDuration prometheus.Histogram
+	ffmpegDuration  prometheus.Histogram
+	mergedSize      prometheus.Histogram
+	inFlight        prometheus.Gauge
+}
+
+func NewPrometheusMetrics() *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "videoconverter_tasks_received_total",
+			Help: "Tasks received from the conversion queue.",
+		}),
+		succeeded: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "videoconverter_tasks_succeeded_total",
+			Help: "Tasks converted and confirmed.",
+		}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "videoconverter_tasks_failed_total",
+			Help: "Failed task attempts by stage.",
+		}, []string{"stage"}),
+		requeued: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "videoconverter_tasks_requeued_total",
+			Help: "Tasks requeued before they started, by reason.",
+		}, []string{"reason"}),
+		processDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "videoconverter_process_duration_seconds",
+			Help:    "Time spent processing a task, from merge to upload.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}),
+		ffmpegDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "videoconverter_ffmpeg_duration_seconds",
+			Help:    "Time spent running ffmpeg.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 14),
+		}),
+		mergedSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "videoconverter_merged_size_bytes",
+			Help:    "Size of the merged input file.",
+			Buckets: prometheus.ExponentialBuckets(1<<20, 4, 10),
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "videoconverter_conversions_in_flight",
+			Help: "Conversions currently running.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.received, m.succeeded, m.failed, m.requeued, m.processDuration, m.ffmpegDuration, m.mergedSize, m.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// WatchFFmpeg exports the number of running ffmpeg conversions reported by
+// inFlight, typically VideoConverter.FFmpegInFlight.
+func (m *PrometheusMetrics) WatchFFmpeg(inFlight func() int) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videoconverter_ffmpeg_in_flight",
+		Help: "ffmpeg conversions currently running.",
+	}, func() float64 {
+		return float64(inFlight())
+	}))
+}
+
+// MetricsHandler serves the registry in the Prometheus exposition format.
+func (m *PrometheusMetrics) MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+func (m *PrometheusMetrics) TaskProcessed() { m.received.Inc() }
+func (m *PrometheusMetrics) TaskSucceeded() { m.succeeded.Inc() }
+func (m *PrometheusMetrics) TaskFailed(stage Stage) {
+	m.failed.WithLabelValues(string(stage)).Inc()
+}
+func (m *PrometheusMetrics) TaskRequeued(reason string) {
+	m.requeued.WithLabelValues(reason).Inc()
+}
+func (m *PrometheusMetrics) ObserveProcessDuration(d time.Duration) {
+	m.processDuration.Observe(d.Seconds())
+}
+func (m *PrometheusMetrics) ObserveFFmpegDuration(d time.Duration) {
+	m.ffmpegDuration.Observe(d.Seconds())
+}
+func (m *PrometheusMetrics) ObserveMergedSize(bytes int64) { m.mergedSize.Observe(float64(bytes)) }
+func (m *PrometheusMetrics) ConversionStarted()            { m.inFlight.Inc() }
+func (m *PrometheusMetrics) ConversionFinished()           { m.inFlight.Dec() }
@@ -0,0 +1,145 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (vc *VideoConverter) parallelRenditions() bool {
+	return vc.options.ParallelRenditions > 1 && len(vc.options.Renditions) > 1
+}
+
+// encodeRenditions encodes every rendition of inputFile in its own ffmpeg
+// process, at most ParallelRenditions at once and each in an ffmpeg slot, and
+// then packages them without re-encoding. The first failing rendition cancels
+// the others.
+func (vc *VideoConverter) encodeRenditions(ctx context.Context, task *VideoTask, inputFile string, out ffmpegOutput, logFile string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	renditions := vc.options.Renditions
+	files := make([]string, len(renditions))
+	logs := make([]string, len(renditions))
+	slots := make(chan struct{}, vc.options.ParallelRenditions)
+	var (
+		wg       sync.WaitGroup
+		failOnce sync.Once
+		failed   error
+	)
+	for i, r := range renditions {
+		files[i] = filepath.Join(out.dir, fmt.Sprintf("rendition_%d.mkv", i))
+		logs[i] = strings.TrimSuffix(logFile, ".log") + fmt.Sprintf("-rendition_%d.log", i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-slots }()
+			release, err := vc.acquireFFmpeg(ctx)
+			if err != nil {
+				return
+			}
+			defer release()
+
+			start := time.Now()
+			err = vc.runFFmpeg(ctx, task, vc.renditionEncodeArgs(inputFile, r, out, files[i]), 0, logs[i])
+			if err != nil {
+				failOnce.Do(func() {
+					failed = fmt.Errorf("rendition %dx%d: %w", r.Width, r.Height, err)
+					cancel()
+				})
+				return
+			}
+			task.log().Info("Rendition encoded", slog.Int("width", r.Width), slog.Int("height", r.Height),
+				slog.Duration("took", time.Since(start)))
+		}()
+	}
+	wg.Wait()
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	if failed != nil {
+		return failed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !vc.options.KeepFFmpegLog {
+		for _, log := range logs {
+			os.Remove(log)
+		}
+	}
+
+	release, err := vc.acquireFFmpeg(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	start := time.Now()
+	if err := vc.runFFmpeg(ctx, task, vc.packageArgs(files, out), 0, logFile); err != nil {
+		return err
+	}
+	task.log().Info("Renditions packaged", slog.Duration("took", time.Since(start)))
+	return nil
+}
+
+// renditionEncodeArgs encodes rendition r of inputFile into dst, a Matroska
+// file so any audio codec can be copied. Keyframes are forced every
+// SegmentDuration: the packaging does not re-encode, so every rendition must
+// already have a keyframe where the muxer cuts a segment.
+func (vc *VideoConverter) renditionEncodeArgs(inputFile string, r Rendition, out ffmpegOutput, dst string) []string {
+	args := append(vc.options.Accel.inputArgs(), "-i", inputFile, "-map", "0:v:0")
+	if vc.options.AudioMode != AudioNone {
+		args = append(args, "-map", "0:a:0?")
+	}
+	args = append(args,
+		"-s:v", fmt.Sprintf("%dx%d", r.Width, r.Height),
+		"-b:v", fmt.Sprintf("%dk", r.VideoBitrate),
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%s)", formatSeconds(vc.options.SegmentDuration)),
+	)
+	args = append(args, vc.options.Accel.outputArgs()...)
+	args = append(args, vc.options.AudioMode.outputArgs()...)
+	if vc.options.AudioMode == AudioAAC {
+		args = append(args, "-b:a", fmt.Sprintf("%dk", r.AudioBitrate))
+	}
+	if out.videoFilter != "" {
+		args = append(args, "-vf", out.videoFilter)
+	}
+	if out.audioFilter != "" {
+		args = append(args, "-af", out.audioFilter)
+	}
+	args = append(args, vc.options.FFmpegExtraArgs...)
+	return append(args, "-f", "matroska", "-y", dst)
+}
+
+// packageArgs maps the encoded renditions in the same order renditionArgs
+// does, so the muxer arguments are the same as for a single encode.
+func (vc *VideoConverter) packageArgs(inputs []string, out ffmpegOutput) []string {
+	args := []string{"-y"}
+	for _, input := range inputs {
+		args = append(args, "-i", input)
+	}
+	formats, _ := out.format.formats()
+	for _, format := range formats {
+		for i := range inputs {
+			args = append(args, "-map", fmt.Sprintf("%d:v:0", i))
+			if vc.options.AudioMode != AudioNone {
+				args = append(args, "-map", fmt.Sprintf("%d:a:0?", i))
+			}
+		}
+		args = append(args, "-c", "copy")
+		args = append(args, vc.muxerArgs(format, out)...)
+	}
+	return args
+}
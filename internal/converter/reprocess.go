@@ -0,0 +1,107 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/streadway/amqp"
+)
+
+// ReprocessReport lists what Reprocess did with each requested video.
+type ReprocessReport struct {
+	Republished []int
+	// AlreadyProcessed were skipped because they are done and force was not
+	// set.
+	AlreadyProcessed []int
+	// Missing have no stored task or their chunks are gone.
+	Missing []int
+}
+
+// Reprocess republishes the stored task of each video to the conversion
+// exchange and resets its status so Handle converts it again. Videos that are
+// already done are only reprocessed with force. Videos whose chunks no longer
+// exist are reported as missing.
+//
+// The conversion queue is not declared: it is exclusive to the workers
+// consuming it, so the exchange routes the task to it. The status is reset
+// before publishing, as a worker receiving the task while the video is still
+// done would skip it, and restored when the publish fails.
+func (vc *VideoConverter) Reprocess(ctx context.Context, routing Routing, videoIDs []int, force bool) (ReprocessReport, error) {
+	var report ReprocessReport
+	for _, videoID := range videoIDs {
+		dbCtx, cancel := vc.dbContext(ctx)
+		status, err := GetStatus(dbCtx, vc.db, videoID)
+		if err != nil {
+			cancel()
+			return report, fmt.Errorf("failed to get status of video %d: %w", videoID, err)
+		}
+		if status == StatusDone && !force {
+			cancel()
+			report.AlreadyProcessed = append(report.AlreadyProcessed, videoID)
+			continue
+		}
+		task, found, err := storedTask(dbCtx, vc.db, videoID)
+		cancel()
+		if err != nil {
+			return report, fmt.Errorf("failed to load task of video %d: %w", videoID, err)
+		}
+		if !found {
+			slog.Warn("No stored task, cannot reprocess", slog.Int("video_id", videoID))
+			report.Missing = append(report.Missing, videoID)
+			continue
+		}
+		if chunks, err := vc.listChunks(task.Path); err != nil || len(chunks) == 0 {
+			slog.Warn("Chunks are gone, cannot reprocess", slog.Int("video_id", videoID), slog.String("path", task.Path))
+			report.Missing = append(report.Missing, videoID)
+			continue
+		}
+
+		// A fresh trace for the new run.
+		task.TraceID = ""
+		body, err := json.Marshal(task)
+		if err != nil {
+			return report, err
+		}
+		dbCtx, cancel = vc.dbContext(ctx)
+		err = SetStatus(dbCtx, vc.db, videoID, StatusQueued)
+		cancel()
+		if err != nil {
+			return report, fmt.Errorf("failed to reset status of video %d: %w", videoID, err)
+		}
+		err = vc.rabbitmqClient.Publish(routing.ConversionExchange, routing.ConversionKey, amqp.Publishing{
+			ContentType: jsonContentType,
+			Body:        body,
+		})
+		if err != nil {
+			dbCtx, cancel = vc.dbContext(ctx)
+			if statusErr := SetStatus(dbCtx, vc.db, videoID, status); statusErr != nil {
+				slog.Error("Failed to restore status after a failed republish", slog.Int("video_id", videoID),
+					slog.String("status", string(status)), slog.String("error", statusErr.Error()))
+			}
+			cancel()
+			return report, fmt.Errorf("failed to republish video %d: %w", videoID, err)
+		}
+		slog.Info("Video republished for reprocessing", slog.Int("video_id", videoID))
+		report.Republished = append(report.Republished, videoID)
+	}
+	return report, nil
+}
+
+func storedTask(ctx context.Context, db *sql.DB, videoID int) (VideoTask, bool, error) {
+	var task VideoTask
+	var body []byte
+	err := db.QueryRowContext(ctx, "select task from conversion_results where video_id = $1", videoID).Scan(&body)
+	if err == sql.ErrNoRows || (err == nil && body == nil) {
+		return task, false, nil
+	}
+	if err != nil {
+		return task, false, dbError(ctx, "load task", err)
+	}
+	if err := json.Unmarshal(body, &task); err != nil {
+		return task, false, err
+	}
+	return task, true, nil
+}
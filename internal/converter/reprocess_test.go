@@ -0,0 +1,66 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// storeTask records task as the stored task of a converted video.
+func storeTask(t *testing.T, fake *fakeDB, task VideoTask) {
+	t.Helper()
+	body, err := json.Marshal(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.results[task.VideoID] = body
+	fake.mu.Unlock()
+	fake.setStatus(task.VideoID, StatusDone)
+}
+
+func TestReprocessPublishesToTheExchange(t *testing.T) {
+	vc, fake := newTestConverter(t, ConversionOptions{})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	storeTask(t, fake, VideoTask{VideoID: 1, Path: dir})
+
+	report, err := vc.Reprocess(context.Background(), Routing{ConversionExchange: "conversion", ConversionKey: "convert", ConversionQueue: "conversions"}, []int{1}, true)
+	if err != nil {
+		t.Fatalf("Reprocess: %v", err)
+	}
+	if len(report.Republished) != 1 {
+		t.Errorf("report = %+v, want video 1 republished", report)
+	}
+	published := vc.rabbitmqClient.(*fakeBroker).messages()
+	if len(published) != 1 {
+		t.Fatalf("published %+v, want the task", published)
+	}
+	if p := published[0]; p.exchange != "conversion" || p.routingKey != "convert" || p.queue != "" {
+		t.Errorf("published to %s/%s declaring %q, want conversion/convert without declaring the queue", p.exchange, p.routingKey, p.queue)
+	}
+	if status := fake.status(1); status != StatusQueued {
+		t.Errorf("status = %q, want %q", status, StatusQueued)
+	}
+}
+
+func TestReprocessRestoresStatusWhenPublishFails(t *testing.T) {
+	vc, fake := newTestConverter(t, ConversionOptions{})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	storeTask(t, fake, VideoTask{VideoID: 1, Path: dir})
+	broker := vc.rabbitmqClient.(*fakeBroker)
+	broker.setErr(errors.New("connection lost"))
+
+	report, err := vc.Reprocess(context.Background(), Routing{ConversionExchange: "conversion", ConversionKey: "convert"}, []int{1}, true)
+	if err == nil {
+		t.Fatal("Reprocess succeeded without publishing")
+	}
+	if len(report.Republished) != 0 {
+		t.Errorf("report = %+v, want nothing republished", report)
+	}
+	if status := fake.status(1); status != StatusDone {
+		t.Errorf("status = %q, want it restored to %q", status, StatusDone)
+	}
+}
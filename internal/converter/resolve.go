@@ -0,0 +1,84 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrInvalidPath = errors.New("invalid task path")
+
+// PathResolver maps a task to the directory holding its chunks.
+type PathResolver func(task VideoTask) (string, error)
+
+// resolvePath replaces task.Path with the resolved path. When AllowedRoot is
+// set, the path and the subtitle file of the task must stay within it once
+// their symlinks are resolved.
+func (vc *VideoConverter) resolvePath(task *VideoTask) error {
+	path := task.Path
+	if vc.options.PathResolver != nil {
+		resolved, err := vc.options.PathResolver(*task)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+		}
+		path = resolved
+	}
+	if path == "" {
+		return fmt.Errorf("%w: path is empty", ErrInvalidPath)
+	}
+	path = filepath.Clean(path)
+	if err := vc.checkAllowed(path); err != nil {
+		return err
+	}
+	task.Path = path
+	if task.SubtitlePath != "" {
+		if err := vc.checkAllowed(subtitlePath(*task)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAllowed rejects a path outside of AllowedRoot.
+func (vc *VideoConverter) checkAllowed(path string) error {
+	root := vc.options.AllowedRoot
+	if root == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("%w: %s is outside of %s", ErrInvalidPath, path, root)
+	}
+	resolvedRoot, err := evalSymlinks(filepath.Clean(root))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	}
+	resolved, err := evalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPath, err)
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s is outside of %s", ErrInvalidPath, path, root)
+	}
+	return nil
+}
+
+// evalSymlinks resolves the symlinks of the part of path that exists, so a
+// directory the chunks have not been uploaded to yet can still be checked.
+func evalSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if !os.IsNotExist(err) {
+		return resolved, err
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolved, err = evalSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
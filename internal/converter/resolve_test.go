@@ -0,0 +1,58 @@
+package converter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePathStaysWithinAllowedRoot(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "uploads")
+	outside := filepath.Join(base, "secrets")
+	for _, dir := range []string{filepath.Join(root, "1"), outside} {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "passwd"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "passwd"), filepath.Join(root, "1", "subtitles.srt")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		task    VideoTask
+		allowed bool
+	}{
+		{"inside", VideoTask{Path: filepath.Join(root, "1")}, true},
+		{"not uploaded yet", VideoTask{Path: filepath.Join(root, "2")}, true},
+		{"relative subtitles", VideoTask{Path: filepath.Join(root, "1"), SubtitlePath: "subs/en.srt"}, true},
+		{"relative path", VideoTask{Path: "uploads/1"}, false},
+		{"dot dot", VideoTask{Path: filepath.Join(root, "..", "secrets")}, false},
+		{"symlinked dir", VideoTask{Path: filepath.Join(root, "linked")}, false},
+		{"below symlinked dir", VideoTask{Path: filepath.Join(root, "linked", "1")}, false},
+		{"subtitles dot dot", VideoTask{Path: filepath.Join(root, "1"), SubtitlePath: "../../secrets/passwd"}, false},
+		{"absolute subtitles", VideoTask{Path: filepath.Join(root, "1"), SubtitlePath: filepath.Join(outside, "passwd")}, false},
+		{"symlinked subtitles", VideoTask{Path: filepath.Join(root, "1"), SubtitlePath: "subtitles.srt"}, false},
+	}
+	vc, _ := newTestConverter(t, ConversionOptions{AllowedRoot: root})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := tt.task
+			err := vc.resolvePath(&task)
+			if tt.allowed && err != nil {
+				t.Errorf("resolvePath(%q, %q) = %v, want it allowed", tt.task.Path, tt.task.SubtitlePath, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrInvalidPath) {
+				t.Errorf("resolvePath(%q, %q) = %v, want ErrInvalidPath", tt.task.Path, tt.task.SubtitlePath, err)
+			}
+		})
+	}
+}
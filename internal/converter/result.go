@@ -0,0 +1,70 @@
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// ConversionResult is what we learned about a video while converting it.
+type ConversionResult struct {
+	VideoID     int
+	Duration    time.Duration
+	Width       int
+	Height      int
+	VideoCodec  string
+	Segments    int
+	OutputBytes int64
+	// Task is stored so the video can be reprocessed later.
+	Task VideoTask
+}
+
+func RecordResult(ctx context.Context, db *sql.DB, result ConversionResult) error {
+	task, err := json.Marshal(result.Task)
+	if err != nil {
+		return err
+	}
+	query := `insert into conversion_results (video_id, duration_seconds, width, height, video_codec, segments, output_bytes, task, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		on conflict (video_id) do update set duration_seconds = excluded.duration_seconds, width = excluded.width,
+			height = excluded.height, video_codec = excluded.video_codec, segments = excluded.segments,
+			output_bytes = excluded.output_bytes, task = excluded.task, created_at = excluded.created_at`
+	_, err = db.ExecContext(ctx, query, result.VideoID, result.Duration.Seconds(), result.Width, result.Height,
+		result.VideoCodec, result.Segments, result.OutputBytes, task, time.Now())
+	if err != nil {
+		slog.Error("Error recording conversion result", slog.Int("video_id", result.VideoID))
+		return dbError(ctx, "record result", err)
+	}
+	return nil
+}
+
+// outputStats counts the media segments and sums the size of every file in the
+// output directories. Manifests add to the size but are not segments.
+func outputStats(dirs []string) (segments int, size int64, err error) {
+	for _, dir := range dirs {
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+			switch filepath.Ext(path) {
+			case ".mpd", ".m3u8":
+			default:
+				segments++
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return segments, size, nil
+}
@@ -0,0 +1,194 @@
+package converter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	retryCountHeader = "x-retry-count"
+	deathHeader      = "x-death"
+)
+
+var ErrInvalidOptions = errors.New("invalid conversion options")
+
+type DeadLetterMessage struct {
+	VideoID   int       `json:"video_id"`
+	Path      string    `json:"path"`
+	Error     string    `json:"error"`
+	Retries   int       `json:"retries"`
+	Timestamp time.Time `json:"timestamp"`
+	Body      string    `json:"body"`
+}
+
+type deadLetterTarget struct {
+	exchange   string
+	routingKey string
+	queue      string
+}
+
+// retryCount returns how many times the delivery was already attempted, taking
+// the larger of our own counter and the broker's x-death bookkeeping.
+func retryCount(d amqp.Delivery) int {
+	count := headerInt(d.Headers[retryCountHeader])
+	if deaths, ok := d.Headers[deathHeader].([]interface{}); ok {
+		var died int
+		for _, death := range deaths {
+			if table, ok := death.(amqp.Table); ok {
+				died += headerInt(table["count"])
+			}
+		}
+		count = max(count, died)
+	}
+	return count
+}
+
+func headerInt(value interface{}) int {
+	switch v := value.(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// isPermanent reports whether retrying the task can never succeed.
+func isPermanent(err error) bool {
+	return errors.Is(err, ErrInvalidInput) || errors.Is(err, ErrInvalidOptions) || errors.Is(err, ErrUnmarshal) ||
+		errors.Is(err, ErrInvalidPath)
+}
+
+// RetryPolicy controls how often processVideo is retried in-process for
+// transient failures before the task goes back to the broker.
+type RetryPolicy struct {
+	// Attempts is the total number of runs. One or less disables retrying.
+	Attempts       int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// isTransient reports whether err may go away by simply running the
+// conversion again: a full disk, an I/O error on the input, or ffmpeg being
+// killed by a signal (usually the OOM killer).
+func isTransient(err error) bool {
+	// A run that hit ConversionTimeout would most likely hit it again.
+	if isPermanent(err) || errors.Is(err, ErrConversionTimeout) {
+		return false
+	}
+	if errors.Is(err, ErrInsufficientDiskSpace) || errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EIO) {
+		return true
+	}
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == -1
+}
+
+// processWithRetry runs the converter, retrying transient failures with
+// exponential backoff according to ProcessRetry.
+func (vc *VideoConverter) processWithRetry(ctx context.Context, task *VideoTask) (*Result, error) {
+	policy := vc.options.ProcessRetry
+	backoff := policy.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		result, err := vc.converter.Convert(ctx, task)
+		if err == nil && result == nil {
+			err = ErrNoResult
+		}
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil || !isTransient(err) {
+			return result, err
+		}
+		task.log().Warn("Transient failure, retrying conversion", slog.Int("attempt", attempt), slog.Duration("backoff", backoff), slog.String("error", err.Error()))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return result, err
+		}
+		backoff = min(backoff*2, policy.MaxBackoff)
+	}
+}
+
+func (vc *VideoConverter) retryBackoff(attempt int) time.Duration {
+	return vc.options.RetryBackoff * time.Duration(1<<attempt)
+}
+
+// retryOrDeadLetter republishes a failed delivery with an incremented retry
+// count, delayed by the broker so the worker is free in the meantime, or
+// dead-letters it once MaxRetries is exhausted.
+func (vc *VideoConverter) retryOrDeadLetter(d amqp.Delivery, task VideoTask, dlq deadLetterTarget, cause error) {
+	if isPermanent(cause) {
+		task.log().Error("Permanent failure, dead-lettering task")
+		vc.deadLetter(d, task, dlq, cause)
+		return
+	}
+
+	attempt := retryCount(d)
+	if attempt >= vc.options.MaxRetries {
+		task.log().Error("Retries exhausted, dead-lettering task", slog.Int("attempts", attempt))
+		vc.deadLetter(d, task, dlq, cause)
+		return
+	}
+
+	backoff := vc.retryBackoff(attempt)
+	task.log().Warn("Retrying task", slog.Int("attempt", attempt+1), slog.Duration("backoff", backoff))
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[retryCountHeader] = int32(attempt + 1)
+	headers[traceIDHeader] = task.TraceID
+	err := vc.rabbitmqClient.PublishDelayed(d.Exchange, d.RoutingKey, backoff, amqp.Publishing{
+		ContentType:   d.ContentType,
+		Headers:       headers,
+		CorrelationId: d.CorrelationId,
+		Body:          d.Body,
+	})
+	if err != nil {
+		vc.logError(task, "Failed to republish task for retry", err)
+		nack(d, task, true)
+		return
+	}
+	ack(d, task)
+}
+
+func (vc *VideoConverter) deadLetter(d amqp.Delivery, task VideoTask, dlq deadLetterTarget, cause error) {
+	if dlq.exchange == "" {
+		task.log().Error("No dead-letter exchange configured, discarding task")
+		nack(d, task, false)
+		return
+	}
+
+	message, err := json.Marshal(DeadLetterMessage{
+		VideoID:   task.VideoID,
+		Path:      task.Path,
+		Error:     cause.Error(),
+		Retries:   retryCount(d),
+		Timestamp: time.Now(),
+		Body:      string(d.Body),
+	})
+	if err != nil {
+		vc.logError(task, "Failed to serialize dead-letter message", err)
+		nack(d, task, false)
+		return
+	}
+	err = vc.rabbitmqClient.PublishMessage(dlq.exchange, dlq.routingKey, dlq.queue, message)
+	if err != nil {
+		vc.logError(task, "Failed to publish task to dead-letter queue", err)
+		nack(d, task, true)
+		return
+	}
+	task.log().Info("Task sent to dead-letter queue")
+	ack(d, task)
+}
@@ -0,0 +1,28 @@
+package converter
+
+import (
+	"context"
+	"io"
+	"os/exec"
+)
+
+// Runner runs ffmpeg and ffprobe. Run returns the combined stdout and stderr
+// of the command, while Stream writes them to stdout and stderr as the
+// command runs. A failed command must return a non-nil error.
+type Runner interface {
+	Run(ctx context.Context, name string, args ...string) ([]byte, error)
+	Stream(ctx context.Context, stdout, stderr io.Writer, name string, args ...string) error
+}
+
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+func (execRunner) Stream(ctx context.Context, stdout, stderr io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
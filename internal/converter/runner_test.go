@@ -0,0 +1,105 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeScript writes an executable shell script into dir.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConversionTimeoutKillsFFmpeg(t *testing.T) {
+	bin := t.TempDir()
+	vc, _ := newTestConverter(t, ConversionOptions{
+		Runner:            execRunner{},
+		FFmpegPath:        writeScript(t, bin, "ffmpeg", "exec sleep 30"),
+		FFprobePath:       writeScript(t, bin, "ffprobe", "echo '"+ffprobeJSON+"'"),
+		ConversionTimeout: 100 * time.Millisecond,
+	})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	start := time.Now()
+	_, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir})
+	if !errors.Is(err, ErrConversionTimeout) || !errors.Is(err, ErrFFmpeg) {
+		t.Fatalf("processVideo error = %v, want ErrConversionTimeout in the ffmpeg stage", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("processVideo took %s, ffmpeg was not killed", elapsed)
+	}
+	if isTransient(err) {
+		t.Error("a timed out conversion is retried in-process")
+	}
+	if _, err := os.Stat(filepath.Join(dir, dashDir)); !os.IsNotExist(err) {
+		t.Errorf("partial output left behind: %v", err)
+	}
+}
+
+func TestConversionTimeoutWithStubRunner(t *testing.T) {
+	started := make(chan struct{}, 1)
+	runner := blockingRunner(started, nil, nil)
+	vc, fake := newTestConverter(t, ConversionOptions{Runner: runner, ConversionTimeout: 20 * time.Millisecond, RetryBackoff: time.Millisecond})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: dir})
+	handle(context.Background(), vc, d)
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Fatalf("delivery was %s, want ack after republishing it", outcome)
+	}
+	if published := vc.rabbitmqClient.(*fakeBroker).messages(); len(published) != 1 || published[0].exchange != "conversion" {
+		t.Errorf("published %+v, want the task retried", published)
+	}
+	if status := fake.status(1); status != StatusFailed {
+		t.Errorf("status = %q, want %q", status, StatusFailed)
+	}
+	if logged := fake.loggedErrors(); !strings.Contains(logged, "FFmpeg conversion timed out") {
+		t.Errorf("logged errors do not report the timeout:\n%s", logged)
+	}
+}
+
+func TestProgressStreamedThroughRunner(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		reported []float64
+	)
+	runner := &stubRunner{stdout: "frame=1\nout_time_ms=5000000\nprogress=continue\nout_time_ms=6000000\nprogress=end\n"}
+	vc, _ := newTestConverter(t, ConversionOptions{
+		Runner: runner,
+		OnProgress: func(videoID int, percent float64) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, percent)
+		},
+	})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	if _, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir}); err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	// The second out_time_ms comes within progressInterval of the first.
+	if want := []float64{50, 100}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("progress = %v, want %v", reported, want)
+	}
+	calls := runner.ffmpegCalls()
+	if len(calls) != 1 || !slices.Contains(calls[0], "pipe:1") {
+		t.Errorf("ffmpeg calls = %q, want the conversion to stream its progress", calls)
+	}
+}
@@ -0,0 +1,87 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	spriteDir     = "sprites"
+	spriteVTT     = "thumbnails.vtt"
+	spriteColumns = 10
+	spriteRows    = 10
+	spriteWidth   = 160
+	spriteHeight  = 90
+)
+
+// generateSprites extracts a frame every SpriteInterval, tiles them into
+// sprite sheets and writes a WebVTT file mapping each interval to its tile.
+// It returns the sheets and the WebVTT file, all under workDir.
+func (vc *VideoConverter) generateSprites(ctx context.Context, inputFile, workDir string, duration time.Duration) ([]string, string, error) {
+	interval := vc.options.SpriteInterval
+	dir := filepath.Join(workDir, spriteDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, "", fmt.Errorf("failed to create sprite directory: %v", err)
+	}
+
+	filter := fmt.Sprintf("fps=1/%s,scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,tile=%dx%d",
+		formatSeconds(interval), spriteWidth, spriteHeight, spriteWidth, spriteHeight, spriteColumns, spriteRows)
+	output, err := vc.runFFmpegCommand(ctx,
+		"-i", inputFile,
+		"-vf", filter,
+		"-an",
+		"-y",
+		filepath.Join(dir, "sprite_%03d.png"),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate sprites: %v, output: %s", err, output)
+	}
+
+	frames := int(math.Ceil(float64(duration) / float64(interval)))
+	perSheet := spriteColumns * spriteRows
+	var sheets []string
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i := 0; i < frames; i++ {
+		sheet := fmt.Sprintf("sprite_%03d.png", i/perSheet+1)
+		if i%perSheet == 0 {
+			sheets = append(sheets, filepath.Join(dir, sheet))
+		}
+		tile := i % perSheet
+		start := time.Duration(i) * interval
+		end := min(start+interval, duration)
+		fmt.Fprintf(&vtt, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n", vttTimestamp(start), vttTimestamp(end), sheet,
+			(tile%spriteColumns)*spriteWidth, (tile/spriteColumns)*spriteHeight, spriteWidth, spriteHeight)
+	}
+	vttFile := filepath.Join(dir, spriteVTT)
+	if err := os.WriteFile(vttFile, []byte(vtt.String()), 0o644); err != nil {
+		return nil, "", fmt.Errorf("failed to write %s: %v", spriteVTT, err)
+	}
+	return sheets, vttFile, nil
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// publishSprites records the paths of the sprites in result, see
+// publishSidecar.
+func (vc *VideoConverter) publishSprites(task *VideoTask, workDir string, sheets []string, vtt string, result *Result) error {
+	var paths []string
+	for _, file := range append(sheets, vtt) {
+		path, err := vc.publishSidecar(task, workDir, file)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, path)
+	}
+	result.Sprites = paths[:len(sheets)]
+	result.SpriteVTT = paths[len(sheets)]
+	return nil
+}
@@ -0,0 +1,183 @@
+package converter
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	subtitleFile = "subtitles.vtt"
+	// subtitlePlaylist is the HLS media playlist of the subtitle track, and
+	// subtitleGroup its rendition group in the master playlist.
+	subtitlePlaylist = "subtitles.m3u8"
+	subtitleGroup    = "subs"
+	// singleStreamPlaylist is the media playlist of a single-stream HLS
+	// output once a master playlist lists its subtitles.
+	singleStreamPlaylist = "stream.m3u8"
+)
+
+// SubtitleMode selects what happens to the subtitle file of a task.
+type SubtitleMode string
+
+const (
+	// SubtitleNone ignores the subtitle file.
+	SubtitleNone SubtitleMode = "none"
+	// SubtitleSoft converts the subtitles to a WebVTT track stored next to
+	// the manifests and listed in them, as a SUBTITLES group of the HLS
+	// master playlist and a text adaptation set of the DASH manifest, and in
+	// the confirmation. A single-stream HLS output gets a master playlist,
+	// its media playlist being renamed to stream.m3u8.
+	SubtitleSoft SubtitleMode = "soft"
+	// SubtitleBurn renders the subtitles into the video frames.
+	SubtitleBurn SubtitleMode = "burn"
+)
+
+func (m SubtitleMode) validate() error {
+	switch m {
+	case SubtitleNone, SubtitleSoft, SubtitleBurn:
+		return nil
+	default:
+		return fmt.Errorf("unsupported subtitle mode %q: must be one of %s, %s or %s", m, SubtitleNone, SubtitleSoft, SubtitleBurn)
+	}
+}
+
+// subtitleSource returns the subtitle file of the task, or an empty path when
+// subtitles are disabled or the file is missing.
+func (vc *VideoConverter) subtitleSource(task *VideoTask) string {
+	if vc.options.SubtitleMode == SubtitleNone || task.SubtitlePath == "" {
+		return ""
+	}
+	path := subtitlePath(*task)
+	if _, err := os.Stat(path); err != nil {
+		task.log().Warn("Subtitle file not found, converting without subtitles", slog.String("path", path), slog.String("error", err.Error()))
+		return ""
+	}
+	return path
+}
+
+// subtitlePath returns the subtitle file of the task, relative paths being
+// relative to the task path.
+func subtitlePath(task VideoTask) string {
+	if filepath.IsAbs(task.SubtitlePath) {
+		return filepath.Clean(task.SubtitlePath)
+	}
+	return filepath.Join(task.Path, task.SubtitlePath)
+}
+
+// burnFilter is the video filter rendering subtitles into the frames. The path
+// is escaped for the filter options, and then quoted for the filtergraph,
+// where a quote has to close the quoted string, be escaped and reopen it.
+func burnFilter(subtitles string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(subtitles)
+	return "subtitles='" + strings.ReplaceAll(escaped, `'`, `'\''`) + "'"
+}
+
+// convertSubtitles writes subtitles as WebVTT into workDir.
+func (vc *VideoConverter) convertSubtitles(ctx context.Context, subtitles, workDir string) (string, error) {
+	vtt := filepath.Join(workDir, subtitleFile)
+	output, err := vc.runFFmpegCommand(ctx,
+		"-i", subtitles,
+		"-c:s", "webvtt",
+		"-y",
+		vtt,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert subtitles: %v, output: %s", err, output)
+	}
+	return vtt, nil
+}
+
+// addSubtitleTracks lists the WebVTT track vtt in the manifests written into
+// workDir for formats. bandwidth is announced for a single-stream HLS output,
+// whose playlist carries none.
+func addSubtitleTracks(workDir string, formats []OutputFormat, manifest, vtt string, duration time.Duration, bandwidth int64) error {
+	for _, format := range formats {
+		dir := formatDir(workDir, format)
+		uri, err := filepath.Rel(dir, vtt)
+		if err != nil {
+			return err
+		}
+		uri = filepath.ToSlash(uri)
+		if format == FormatHLS {
+			err = addHLSSubtitles(dir, manifest+hlsExt, uri, duration, bandwidth)
+		} else {
+			err = addDASHSubtitles(filepath.Join(dir, manifest+dashExt), uri)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add subtitles to the %s manifest: %v", format, err)
+		}
+	}
+	return nil
+}
+
+// addHLSSubtitles writes the media playlist of the subtitle track and adds it
+// to the master playlist as a SUBTITLES group every variant refers to.
+func addHLSSubtitles(dir, master, uri string, duration time.Duration, bandwidth int64) error {
+	playlist := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXTINF:%s,\n%s\n#EXT-X-ENDLIST\n",
+		int(math.Ceil(duration.Seconds())), formatSeconds(duration), uri)
+	if err := os.WriteFile(filepath.Join(dir, subtitlePlaylist), []byte(playlist), 0o644); err != nil {
+		return err
+	}
+
+	masterFile := filepath.Join(dir, master)
+	data, err := os.ReadFile(masterFile)
+	if err != nil {
+		return err
+	}
+	content := string(data)
+	if !strings.Contains(content, "#EXT-X-STREAM-INF:") {
+		// A single stream has no master playlist to list the group in.
+		if err := os.Rename(masterFile, filepath.Join(dir, singleStreamPlaylist)); err != nil {
+			return err
+		}
+		content = fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=%d\n%s\n", max(bandwidth, 1), singleStreamPlaylist)
+	}
+
+	media := fmt.Sprintf(`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="%s",NAME="Subtitles",DEFAULT=NO,AUTOSELECT=YES,URI="%s"`, subtitleGroup, subtitlePlaylist)
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	out := make([]string, 0, len(lines)+1)
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			line += fmt.Sprintf(`,SUBTITLES="%s"`, subtitleGroup)
+		}
+		out = append(out, line)
+		if i == 0 {
+			out = append(out, media)
+		}
+	}
+	return os.WriteFile(masterFile, []byte(strings.Join(out, "\n")+"\n"), 0o644)
+}
+
+// addDASHSubtitles adds the subtitle track to the last period of the manifest
+// as a text adaptation set.
+func addDASHSubtitles(manifest, uri string) error {
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	content := string(data)
+	end := strings.LastIndex(content, "</Period>")
+	if end < 0 {
+		return fmt.Errorf("%s has no period", manifest)
+	}
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(uri))
+	set := fmt.Sprintf("\t\t<AdaptationSet id=\"%d\" contentType=\"text\" mimeType=\"text/vtt\">\n"+
+		"\t\t\t<Role schemeIdUri=\"urn:mpeg:dash:role:2011\" value=\"subtitle\"/>\n"+
+		"\t\t\t<Representation id=\"subtitles\" bandwidth=\"256\">\n"+
+		"\t\t\t\t<BaseURL>%s</BaseURL>\n"+
+		"\t\t\t</Representation>\n"+
+		"\t\t</AdaptationSet>\n",
+		strings.Count(content, "<AdaptationSet"), escaped.String())
+	// Inserted on its own lines, before the line closing the period.
+	end = strings.LastIndex(content[:end], "\n") + 1
+	return os.WriteFile(manifest, []byte(content[:end]+set+content[end:]), 0o644)
+}
@@ -0,0 +1,144 @@
+package converter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getToken reads a token up to one of term the way ffmpeg's av_get_token
+// does, unescaping backslashes and removing single quotes.
+func getToken(s, term string) string {
+	var token strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case strings.IndexByte(term, c) >= 0:
+			return token.String()
+		case c == '\\' && i+1 < len(s):
+			i++
+			token.WriteByte(s[i])
+		case c == '\'':
+			for i++; i < len(s) && s[i] != '\''; i++ {
+				token.WriteByte(s[i])
+			}
+		default:
+			token.WriteByte(c)
+		}
+	}
+	return token.String()
+}
+
+func TestBurnFilterSurvivesFilterParsing(t *testing.T) {
+	for _, path := range []string{
+		"/subs/movie.srt",
+		"/subs/it's here.srt",
+		"/subs/'quoted'.srt",
+		`C:\subs\movie.srt`,
+		"/subs/a,b;[c]=d.srt",
+	} {
+		filter := burnFilter(path)
+		name, args, ok := strings.Cut(filter, "=")
+		if !ok || name != "subtitles" {
+			t.Fatalf("burnFilter(%q) = %q, want the subtitles filter", path, filter)
+		}
+		// The filtergraph unquotes the arguments, then the filter options
+		// unescape the file name.
+		if got := getToken(getToken(args, "[],;"), ":"); got != path {
+			t.Errorf("burnFilter(%q) = %q, which ffmpeg reads as %q", path, filter, got)
+		}
+	}
+}
+
+func TestAddSubtitleTracks(t *testing.T) {
+	tests := []struct {
+		name   string
+		format OutputFormat
+		// manifest is what ffmpeg wrote, and want what it must contain
+		// once the subtitles are listed.
+		manifest string
+		want     []string
+		files    map[string]string
+	}{
+		{
+			name:     "hls ladder",
+			format:   FormatHLS,
+			manifest: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080\nstream_0.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720\nstream_1.m3u8\n",
+			want: []string{
+				"#EXTM3U\n" + `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Subtitles",DEFAULT=NO,AUTOSELECT=YES,URI="subtitles.m3u8"` + "\n",
+				`#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,SUBTITLES="subs"` + "\nstream_0.m3u8\n",
+				`#EXT-X-STREAM-INF:BANDWIDTH=2800000,RESOLUTION=1280x720,SUBTITLES="subs"` + "\nstream_1.m3u8\n",
+			},
+			files: map[string]string{subtitlePlaylist: "#EXTINF:10,\n../subtitles.vtt\n#EXT-X-ENDLIST"},
+		},
+		{
+			name:     "hls single stream",
+			format:   FormatHLS,
+			manifest: "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000000,\nsegment_000.ts\n#EXT-X-ENDLIST\n",
+			want: []string{
+				`URI="subtitles.m3u8"`,
+				"#EXT-X-STREAM-INF:BANDWIDTH=5000000,SUBTITLES=\"subs\"\n" + singleStreamPlaylist + "\n",
+			},
+			files: map[string]string{singleStreamPlaylist: "segment_000.ts"},
+		},
+		{
+			name:   "dash",
+			format: FormatDASH,
+			manifest: `<?xml version="1.0" encoding="utf-8"?>
+<MPD>
+	<Period id="0" start="PT0.0S">
+		<AdaptationSet id="0" contentType="video"></AdaptationSet>
+		<AdaptationSet id="1" contentType="audio"></AdaptationSet>
+	</Period>
+</MPD>
+`,
+			want: []string{
+				`<AdaptationSet id="1" contentType="audio"></AdaptationSet>
+		<AdaptationSet id="2" contentType="text" mimeType="text/vtt">`,
+				"<BaseURL>../subtitles.vtt</BaseURL>",
+				"</AdaptationSet>\n\t</Period>\n</MPD>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := t.TempDir()
+			dir := formatDir(workDir, tt.format)
+			ext := dashExt
+			if tt.format == FormatHLS {
+				ext = hlsExt
+			}
+			manifest := filepath.Join(dir, "output"+ext)
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(manifest, []byte(tt.manifest), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := addSubtitleTracks(workDir, []OutputFormat{tt.format}, "output", filepath.Join(workDir, subtitleFile), 10*time.Second, 5000000)
+			if err != nil {
+				t.Fatalf("addSubtitleTracks: %v", err)
+			}
+			content, err := os.ReadFile(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(string(content), want) {
+					t.Errorf("manifest lacks %q:\n%s", want, content)
+				}
+			}
+			for name, want := range tt.files {
+				content, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.Contains(string(content), want) {
+					t.Errorf("%s lacks %q:\n%s", name, want, content)
+				}
+			}
+		})
+	}
+}
@@ -1,157 +1,748 @@
-package converter
-
-import (
-	"database/sql"
-	"encoding/json"
-	"fmt"
-	"imersaofc/internal/rabbitmq"
-	"log/slog"
-	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
-	"sort"
-	"strconv"
-	"time"
-
-	"github.com/streadway/amqp"
-)
-
-type VideoConverter struct {
-	db             *sql.DB
-	rabbitmqClient *rabbitmq.RabbitClient
-}
-
-func NewVideoConverter(rabbitmqClient *rabbitmq.RabbitClient, db *sql.DB) *VideoConverter {
-	return &VideoConverter{
-		rabbitmqClient: rabbitmqClient,
-		db:             db,
-	}
-}
-
-type VideoTask struct {
-	VideoID int    `json:"video_id"`
-	Path    string `json:"path"`
-}
-
-func (vc *VideoConverter) Handle(d amqp.Delivery, conversionExch, comfirmationKey, confirmationQueue string) {
-	var task VideoTask
-	err := json.Unmarshal(d.Body, &task)
-	if err != nil {
-		vc.logError(task, "Failed to unmarshal task", err)
-		return
-	}
-
-	if IsProcessed(vc.db, task.VideoID) {
-		slog.Warn("Video already processed", slog.Int("video_id", task.VideoID))
-		d.Ack(false)
-		return
-	}
-
-	err = vc.processVideo(&task)
-	if err != nil {
-		vc.logError(task, "Failed to process video", err)
-		return
-	}
-
-	err = MarkProcessed(vc.db, task.VideoID)
-	if err != nil {
-		vc.logError(task, "Failed to mark video as processed", err)
-		return
-	}
-	d.Ack(false)
-	slog.Info("Video marked as processed", slog.Int("video_id", task.VideoID))
-
-	confirmationMessage := []byte(fmt.Sprintf(`{"video_id": %d, "path": "%s"}`, task.VideoID, task.Path))
-	err = vc.rabbitmqClient.PublishMessage(conversionExch, comfirmationKey, confirmationQueue, confirmationMessage)
-
-}
-
-func (vc *VideoConverter) processVideo(task *VideoTask) error {
-	mergedFile := filepath.Join(task.Path, "merged.mp4")
-	mpegDashPath := filepath.Join(task.Path, "mpeg-dash")
-
-	slog.Info("Merging chunks", slog.String("path", task.Path))
-	err := vc.mergeChunks(task.Path, mergedFile)
-	if err != nil {
-		vc.logError(*task, "Failed to merge chunks", err)
-		return err
-	}
-	slog.Info("Creating mpeg-dash dir", slog.String("path", task.Path))
-	err = os.MkdirAll(mpegDashPath, os.ModeAppend)
-	if err != nil {
-		vc.logError(*task, "Failed to create mpeg-dash directory", err)
-		return err
-	}
-	slog.Info("Converting to mpeg-dash", slog.String("path", task.Path))
-	ffmpegCmd := exec.Command(
-		"ffmpeg", "-i", mergedFile,
-		"-f", "dash",
-		filepath.Join(mpegDashPath, "output.mpd"),
-	)
-
-	output, err := ffmpegCmd.CombinedOutput()
-	if err != nil {
-		vc.logError(*task, "Failed to convert to mpeg-dash, output"+string(output), err)
-		return err
-	}
-	slog.Info("Video converted to mpeg-dash", slog.String("path", mpegDashPath))
-	err = os.Remove(mergedFile)
-	if err != nil {
-		vc.logError(*task, "Failed to remove merged file", err)
-		return err
-	}
-	return nil
-}
-
-func (vc *VideoConverter) logError(task VideoTask, message string, err error) {
-	errorData := map[string]any{
-		"video_id": task.VideoID,
-		"error":    message,
-		"details":  err.Error(),
-		"time":     time.Now(),
-	}
-	serializedError, _ := json.Marshal(errorData)
-	slog.Error("Processing error", slog.String("error_details", string(serializedError)))
-
-	RegisterError(vc.db, errorData, err)
-
-}
-
-func (vc *VideoConverter) extractNumber(fileName string) int {
-	re := regexp.MustCompile(`(\d+)`)
-	numStr := re.FindString(filepath.Base(fileName))
-	num, err := strconv.Atoi(numStr)
-	if err != nil {
-		return -1
-	}
-	return num
-}
-
-func (vc *VideoConverter) mergeChunks(inputDir string, outputFile string) error {
-	// Get all chunk files in the input directory
-	chunks, err := filepath.Glob(filepath.Join(inputDir, "*.chunk"))
-	if err != nil {
-		return fmt.Errorf("failed to find chunks: %v", err)
-	}
-	sort.Slice(chunks, func(i, j int) bool {
-		return vc.extractNumber(chunks[i]) < vc.extractNumber(chunks[j])
-	})
-	output, err := os.Create(outputFile)
-	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
-	}
-	defer output.Close()
-	for _, chunk := range chunks {
-		input, err := os.Open(chunk)
-		if err != nil {
-			return fmt.Errorf("failed to read chunk file: %v", err)
-		}
-		_, err = output.ReadFrom(input)
-		if err != nil {
-			return fmt.Errorf("failed to write chunk %s to merged file: %v", chunk, err)
-		}
-		input.Close()
-	}
-	return nil
-}
+package converter
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imersaofc/internal/rabbitmq"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// broker is the part of the RabbitMQ client the converter consumes and
+// publishes with.
+type broker interface {
+	ConsumeMessages(exchange, routingKey, queueName string) (<-chan amqp.Delivery, error)
+	SetPrefetch(prefetch int)
+	Publish(exchange, routingKey string, msg amqp.Publishing) error
+	PublishDelayed(exchange, routingKey string, delay time.Duration, msg amqp.Publishing) error
+	PublishMessage(exchange, routingKey, queueName string, message []byte) error
+	PublishToQueue(exchange, routingKey, queueName string, msg amqp.Publishing) error
+	StopConsuming() error
+	Close() error
+}
+
+type VideoConverter struct {
+	db             *sql.DB
+	rabbitmqClient broker
+	options        ConversionOptions
+
+	mu           sync.Mutex
+	shuttingDown bool
+	inFlight     sync.WaitGroup
+	// aborted is cancelled when Shutdown gives up waiting, which cancels
+	// every running task.
+	aborted context.Context
+	abort   context.CancelFunc
+	// ffmpegSlots bounds concurrent ffmpeg runs when MaxConcurrentFFmpeg is
+	// set; nil means unbounded.
+	ffmpegSlots chan struct{}
+	converter   Converter
+}
+
+func NewVideoConverter(rabbitmqClient *rabbitmq.RabbitClient, db *sql.DB, options ConversionOptions) (*VideoConverter, error) {
+	localBinaries := options.Converter == nil && options.Runner == nil
+	options = options.withDefaults()
+	if err := validateExtraArgs(options.FFmpegExtraArgs); err != nil {
+		return nil, err
+	}
+	if err := validateRenditions(options.Renditions); err != nil {
+		return nil, err
+	}
+	if err := options.AudioMode.validate(); err != nil {
+		return nil, err
+	}
+	if err := options.SubtitleMode.validate(); err != nil {
+		return nil, err
+	}
+	if err := options.Accel.checkFilters(options.Renditions, options.SubtitleMode); err != nil {
+		return nil, err
+	}
+	if err := options.Packaging.validate(); err != nil {
+		return nil, err
+	}
+	if options.DASHContainer != nil {
+		if err := options.DASHContainer.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if options.NormalizeLoudness && options.AudioMode != AudioAAC {
+		return nil, fmt.Errorf("loudness normalization requires audio mode %s, got %s", AudioAAC, options.AudioMode)
+	}
+	if _, err := filepath.Match(options.ChunkPattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid chunk pattern %q: %v", options.ChunkPattern, err)
+	}
+	if options.ChunkIndex != ChunkIndexLast && options.ChunkIndex != ChunkIndexFirst {
+		return nil, fmt.Errorf("unsupported chunk index strategy %q", options.ChunkIndex)
+	}
+	if name := options.ManifestName; name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid manifest name %q: must be a file name", name)
+	}
+	if options.FirstChunkIndex < 0 {
+		return nil, fmt.Errorf("invalid first chunk index %d: must not be negative", options.FirstChunkIndex)
+	}
+	if localBinaries {
+		if err := resolveBinaries(&options); err != nil {
+			return nil, err
+		}
+	}
+
+	var ffmpegSlots chan struct{}
+	if options.MaxConcurrentFFmpeg > 0 {
+		ffmpegSlots = make(chan struct{}, options.MaxConcurrentFFmpeg)
+	}
+	aborted, abort := context.WithCancel(context.Background())
+	vc := &VideoConverter{
+		rabbitmqClient: rabbitmqClient,
+		db:             db,
+		options:        options,
+		aborted:        aborted,
+		abort:          abort,
+		ffmpegSlots:    ffmpegSlots,
+		converter:      options.Converter,
+	}
+	if vc.converter == nil {
+		vc.converter = ffmpegConverter{vc: vc}
+	}
+	return vc, nil
+}
+
+// resolveBinaries checks that ffmpeg and ffprobe can run and that the
+// configured encoder is available.
+func resolveBinaries(options *ConversionOptions) error {
+	ffmpegPath, err := exec.LookPath(options.FFmpegPath)
+	if err != nil {
+		return fmt.Errorf("ffmpeg binary %q is not executable: %w", options.FFmpegPath, err)
+	}
+	options.FFmpegPath = ffmpegPath
+	if err := ValidateFFmpeg(options.FFmpegPath); err != nil {
+		return err
+	}
+	ffprobePath, err := exec.LookPath(options.FFprobePath)
+	if err != nil {
+		return fmt.Errorf("ffprobe binary %q is not executable: %w", options.FFprobePath, err)
+	}
+	options.FFprobePath = ffprobePath
+
+	options.Accel, err = resolveAccel(options.FFmpegPath, options.Accel)
+	return err
+}
+
+type VideoTask struct {
+	VideoID        int          `json:"video_id"`
+	Path           string       `json:"path"`
+	OutputFormat   OutputFormat `json:"output_format,omitempty"`
+	ExpectedChunks int          `json:"expected_chunks,omitempty"`
+	ExpectedSize   int64        `json:"expected_size,omitempty"`
+	// Checksums maps a chunk file name to its hex encoded SHA-256.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// TraceID correlates every log line of the task. The x-trace-id header
+	// takes precedence; one is generated when neither is set.
+	TraceID string `json:"trace_id,omitempty"`
+	// CorrelationID identifies the request across services. The message
+	// CorrelationId is used when the body does not set it, and it is passed
+	// on to the confirmation.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// SubtitlePath is an optional subtitle file, relative to Path unless
+	// absolute, handled according to SubtitleMode. Like Path, it must be
+	// within AllowedRoot when that is set.
+	SubtitlePath string `json:"subtitle_path,omitempty"`
+
+	logger *slog.Logger
+}
+
+// log returns the logger scoped to the task.
+func (t VideoTask) log() *slog.Logger {
+	if t.logger == nil {
+		return slog.Default()
+	}
+	return t.logger
+}
+
+// Handle converts the task of d, publishing the confirmation and dead-letters
+// according to routing, and settles d.
+func (vc *VideoConverter) Handle(ctx context.Context, d amqp.Delivery, routing Routing) {
+	dlq := deadLetterTarget{exchange: routing.DeadLetterExchange, routingKey: routing.DeadLetterKey, queue: routing.DeadLetterQueue}
+	var task VideoTask
+	if !vc.begin() {
+		slog.Warn("Shutting down, requeueing delivery")
+		nack(d, task, true)
+		return
+	}
+	defer vc.inFlight.Done()
+	ctx, cancel := vc.abortable(ctx)
+	defer cancel()
+	settled := trackSettlement(&d)
+	defer vc.recoverDelivery(d, &task, settled, dlq)
+	vc.options.Metrics.TaskProcessed()
+	ctx = propagator.Extract(ctx, amqpCarrier(d.Headers))
+	ctx, span := vc.tracer().Start(ctx, "conversion.handle", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	err := json.Unmarshal(d.Body, &task)
+	task.TraceID = traceID(d, task)
+	if task.CorrelationID == "" {
+		task.CorrelationID = d.CorrelationId
+	}
+	task.logger = slog.With(slog.String("trace_id", task.TraceID), slog.String("correlation_id", task.CorrelationID),
+		slog.Int("video_id", task.VideoID))
+	span.SetAttributes(attribute.Int("video_id", task.VideoID))
+	if err != nil {
+		err = withStage(StageUnmarshal, err)
+		vc.options.Metrics.TaskFailed(StageUnmarshal)
+		vc.logError(task, "Failed to unmarshal task", err)
+		vc.deadLetter(d, task, dlq, err)
+		return
+	}
+	if err := vc.resolvePath(&task); err != nil {
+		err = withStage(StageUnmarshal, err)
+		vc.options.Metrics.TaskFailed(StageUnmarshal)
+		vc.logError(task, "Invalid task path", err)
+		vc.deadLetter(d, task, dlq, err)
+		return
+	}
+
+	if vc.alreadyProcessed(ctx, d, task, func() {}) {
+		return
+	}
+	if vc.lowOnDisk(&task) {
+		vc.requeueAfter(ctx, d, task, backpressureDelay, requeueLowDisk)
+		return
+	}
+
+	lockCtx, cancelLock := vc.dbContext(ctx)
+	unlock, locked, err := lockVideo(lockCtx, vc.db, task.VideoID)
+	cancelLock()
+	if err != nil {
+		err = withStage(StageDB, err)
+		vc.options.Metrics.TaskFailed(StageDB)
+		vc.logError(task, "Failed to lock video", err)
+		if isDBTimeout(err) {
+			nack(d, task, true)
+			return
+		}
+		vc.retryOrDeadLetter(d, task, dlq, err)
+		return
+	}
+	if !locked {
+		// Once the worker holding the lock is done, the requeued delivery is
+		// acked as already processed, or converted if that worker failed.
+		task.log().Warn("Video is being processed by another worker, requeueing")
+		vc.requeueAfter(ctx, d, task, vc.options.LockRetryDelay, requeueLocked)
+		return
+	}
+	// The lock is released before the delivery is settled, so that a copy
+	// requeued or republished for a retry is not turned away as a duplicate.
+	unlock = sync.OnceFunc(unlock)
+	defer unlock()
+	// Another worker may have finished between the first check and the lock.
+	if vc.alreadyProcessed(ctx, d, task, unlock) {
+		return
+	}
+
+	taskCtx := ctx
+	if vc.options.TaskTimeout > 0 {
+		var cancel context.CancelFunc
+		taskCtx, cancel = context.WithTimeout(ctx, vc.options.TaskTimeout)
+		defer cancel()
+	}
+
+	vc.options.Hooks.beforeProcess(task)
+	start := time.Now()
+	vc.options.Metrics.ConversionStarted()
+	result, err := vc.processWithRetry(taskCtx, &task)
+	vc.options.Metrics.ConversionFinished()
+	vc.options.Metrics.ObserveProcessDuration(time.Since(start))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		vc.options.Metrics.TaskFailed(failureStage(err, StageFFmpeg))
+		vc.logError(task, "Failed to process video", err)
+		vc.options.Hooks.onError(task, err)
+		unlock()
+		if ctx.Err() != nil {
+			task.log().Warn("Video processing cancelled, requeueing")
+			nack(d, task, true)
+			return
+		}
+		if errors.Is(err, ErrInsufficientDiskSpace) {
+			// Another worker may have room for it.
+			task.log().Warn("Not enough disk space, requeueing")
+			nack(d, task, true)
+			return
+		}
+		vc.retryOrDeadLetter(d, task, dlq, err)
+		return
+	}
+
+	confirmation := vc.confirmation(task, result)
+	confirmationMessage, contentType, err := vc.confirmationPayload(task, result, confirmation)
+	if err != nil {
+		err = withStage(StagePublish, err)
+		vc.options.Metrics.TaskFailed(StagePublish)
+		vc.logError(task, "Failed to build confirmation", err)
+		vc.options.Hooks.onError(task, err)
+		// The video stays converted but not done, so it can be reprocessed
+		// once the builder is fixed.
+		statusCtx, cancelStatus := vc.dbContext(ctx)
+		if statusErr := SetStatus(statusCtx, vc.db, task.VideoID, StatusFailed); statusErr != nil {
+			vc.logError(task, "Failed to mark video as failed", statusErr)
+		}
+		cancelStatus()
+		unlock()
+		vc.deadLetter(d, task, dlq, err)
+		return
+	}
+
+	// The confirmation goes to the outbox in the same transaction that marks
+	// the video as processed; the OutboxPublisher delivers it to the broker.
+	markCtx, markSpan := vc.tracer().Start(ctx, "conversion.mark_processed")
+	markCtx, cancelMark := vc.dbContext(markCtx)
+	marked, err := MarkProcessedWithOutbox(markCtx, vc.db, task.VideoID, OutboxMessage{
+		Exchange:      routing.ConversionExchange,
+		RoutingKey:    routing.ConfirmationKey,
+		Queue:         routing.ConfirmationQueue,
+		Payload:       confirmationMessage,
+		ContentType:   contentType,
+		Headers:       traceHeaders(ctx),
+		CorrelationID: task.CorrelationID,
+	})
+	cancelMark()
+	endSpan(markSpan, err)
+	unlock()
+	if err != nil {
+		err = withStage(StageDB, err)
+		vc.options.Metrics.TaskFailed(StageDB)
+		vc.logError(task, "Failed to mark video as processed", err)
+		vc.options.Hooks.onError(task, err)
+		if isDBTimeout(err) {
+			nack(d, task, true)
+			return
+		}
+		vc.retryOrDeadLetter(d, task, dlq, err)
+		return
+	}
+	if !marked {
+		task.log().Warn("Video was marked as processed by another worker, skipping confirmation")
+		vc.options.Metrics.TaskSucceeded()
+		ack(d, task)
+		return
+	}
+	vc.options.Metrics.TaskSucceeded()
+	ack(d, task)
+	task.log().Info("Video marked as processed")
+	vc.options.Hooks.afterPublish(task, confirmation)
+
+	if vc.options.CompletionWebhook != "" {
+		vc.notifyWebhook(ctx, task, WebhookPayload{VideoID: task.VideoID, Location: confirmation.Path, Media: result.Media})
+	}
+
+	if vc.options.RemoveChunksAfterMerge {
+		vc.removeChunks(task, result.chunks)
+	}
+}
+
+// alreadyProcessed acks the delivery when the video is already done and
+// requeues it when the database does not answer in time, calling unlock
+// before settling it. It reports whether the delivery was settled.
+func (vc *VideoConverter) alreadyProcessed(ctx context.Context, d amqp.Delivery, task VideoTask, unlock func()) bool {
+	ctx, cancel := vc.dbContext(ctx)
+	defer cancel()
+	processed, err := IsProcessed(ctx, vc.db, task.VideoID)
+	if isDBTimeout(err) {
+		vc.options.Metrics.TaskFailed(StageDB)
+		vc.logError(task, "Failed to check if video is processed", withStage(StageDB, err))
+		unlock()
+		nack(d, task, true)
+		return true
+	}
+	if err != nil {
+		task.log().Error("Error checking if video is processed", slog.String("error", err.Error()))
+		return false
+	}
+	if processed {
+		task.log().Warn("Video already processed")
+		vc.options.Metrics.TaskSucceeded()
+		unlock()
+		ack(d, task)
+	}
+	return processed
+}
+
+// dbContext bounds a database call with DBTimeout.
+func (vc *VideoConverter) dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, vc.options.DBTimeout)
+}
+
+func (vc *VideoConverter) processVideo(ctx context.Context, task *VideoTask) (result Result, err error) {
+	statusCtx, cancelStatus := vc.dbContext(ctx)
+	statusErr := SetStatus(statusCtx, vc.db, task.VideoID, StatusProcessing)
+	cancelStatus()
+	if statusErr != nil {
+		task.log().Warn("Could not record processing status", slog.String("error", statusErr.Error()))
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		// Recorded even when the task was cancelled.
+		statusCtx, cancelStatus := vc.dbContext(context.WithoutCancel(ctx))
+		defer cancelStatus()
+		if statusErr := SetStatus(statusCtx, vc.db, task.VideoID, StatusFailed); statusErr != nil {
+			task.log().Warn("Could not record failed status", slog.String("error", statusErr.Error()))
+		}
+	}()
+
+	workDir, err := vc.workDir(task)
+	if err != nil {
+		vc.logError(*task, "Failed to create work directory", err)
+		return result, withStage(StageStorage, err)
+	}
+	outputPath := vc.outputPath(task)
+	mergedFile := filepath.Join(workDir, "merged.mp4")
+	if workDir != outputPath {
+		defer func() {
+			// An interrupted merge is kept for the retry to resume it.
+			if _, err := os.Stat(mergedFile + mergeStateSuffix); err == nil {
+				return
+			}
+			os.RemoveAll(workDir)
+		}()
+	}
+
+	outputFormat := vc.outputFormat(*task)
+	outputDirs, err := vc.outputDirs(workDir, outputFormat)
+	if err != nil {
+		vc.logError(*task, "Invalid conversion options", err)
+		return result, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+	}
+	formats, _ := outputFormat.formats()
+	result.Location = outputPath
+	result.Format = outputFormat
+	result.Manifests = manifestPaths(formats, vc.manifestName(*task))
+
+	defer func() {
+		if err != nil && !vc.options.KeepFailedArtifacts {
+			vc.removePartialOutput(*task, mergedFile, outputDirs...)
+		}
+	}()
+
+	var keyInfoFile string
+	if vc.options.KeyProvider != nil && (outputFormat == FormatHLS || outputFormat == FormatBoth) {
+		var removeKey func()
+		keyInfoFile, removeKey, err = vc.writeKeyInfo(task.VideoID)
+		if err != nil {
+			vc.logError(*task, "Failed to prepare HLS encryption", err)
+			return result, withStage(StageFFmpeg, err)
+		}
+		defer removeKey()
+	}
+
+	subtitles := vc.subtitleSource(task)
+	output := ffmpegOutput{
+		dir:         workDir,
+		format:      outputFormat,
+		manifest:    vc.manifestName(*task),
+		keyInfoFile: keyInfoFile,
+	}
+	if subtitles != "" && vc.options.SubtitleMode == SubtitleBurn {
+		output.videoFilter = burnFilter(subtitles)
+	}
+	args, err := vc.ffmpegArgs(mergedFile, output)
+	if err != nil {
+		vc.logError(*task, "Invalid conversion options", err)
+		return result, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+	}
+
+	if err := vc.checkDiskSpace(task, workDir); err != nil {
+		vc.logError(*task, "Not enough disk space for conversion", err)
+		return result, withStage(StageStorage, err)
+	}
+
+	task.log().Info("Merging chunks", slog.String("path", task.Path))
+	mergeCtx, mergeSpan := vc.tracer().Start(ctx, "conversion.merge")
+	merged, chunks, err := vc.mergeChunks(mergeCtx, task, mergedFile)
+	endSpan(mergeSpan, err)
+	if err != nil {
+		message := "Failed to merge chunks"
+		if errors.Is(err, ErrNoChunks) {
+			message = "Upload incomplete, no chunks to merge"
+		}
+		vc.logError(*task, message, err)
+		return result, withStage(StageMerge, err)
+	}
+	task.log().Info("Chunks merged", slog.Int64("bytes", merged))
+	vc.options.Metrics.ObserveMergedSize(merged)
+	result.chunks = chunks
+	mediaInfo, err := vc.probeInput(ctx, mergedFile)
+	if err != nil {
+		vc.logError(*task, "Merged file is not a valid video", err)
+		return result, withStage(StageMerge, err)
+	}
+	result.Media = mediaInfo
+	task.log().Info("Probed merged file", slog.Duration("duration", mediaInfo.Duration),
+		slog.String("codec", mediaInfo.VideoCodec), slog.Int("width", mediaInfo.Width), slog.Int("height", mediaInfo.Height))
+	vc.options.Hooks.afterMerge(*task, mergedFile, mediaInfo)
+	for _, dir := range outputDirs {
+		task.log().Info("Creating output dir", slog.String("path", dir))
+		// A reprocessed video starts from an empty directory, so no segment
+		// of the previous conversion is left behind.
+		err = os.RemoveAll(dir)
+		if err == nil {
+			err = os.MkdirAll(dir, 0o755)
+		}
+		if err != nil {
+			vc.logError(*task, "Failed to create output directory", err)
+			return result, withStage(StageStorage, err)
+		}
+	}
+	release, err := vc.acquireFFmpeg(ctx)
+	if err != nil {
+		vc.logError(*task, "Cancelled while waiting for an ffmpeg slot", err)
+		return result, withStage(StageFFmpeg, err)
+	}
+	task.log().Info("Converting video", slog.String("path", task.Path), slog.String("format", string(outputFormat)))
+	ffmpegStart := time.Now()
+	ffmpegCtx := ctx
+	if vc.options.ConversionTimeout > 0 {
+		var cancel context.CancelFunc
+		ffmpegCtx, cancel = context.WithTimeout(ctx, vc.options.ConversionTimeout)
+		defer cancel()
+	}
+	ffmpegCtx, ffmpegSpan := vc.tracer().Start(ffmpegCtx, "conversion.ffmpeg")
+	// The loudness analysis runs in the slot of the conversion.
+	if vc.options.NormalizeLoudness {
+		output.audioFilter, err = vc.loudnessFilter(ffmpegCtx, task, mergedFile, mediaInfo)
+		if err == nil && output.audioFilter != "" {
+			args, err = vc.ffmpegArgs(mergedFile, output)
+		}
+		if err != nil {
+			release()
+			endSpan(ffmpegSpan, err)
+			vc.logError(*task, "Failed to measure loudness", err)
+			return result, withStage(StageFFmpeg, err)
+		}
+	}
+	ffmpegLog := filepath.Join(workDir, ffmpegLogFile)
+	if vc.parallelRenditions() {
+		// Every rendition process takes a slot of its own.
+		release()
+		err = vc.encodeRenditions(ffmpegCtx, task, mergedFile, output, ffmpegLog)
+	} else {
+		err = vc.runFFmpeg(ffmpegCtx, task, args, mediaInfo.Duration, ffmpegLog)
+		release()
+	}
+	endSpan(ffmpegSpan, err)
+	vc.options.Metrics.ObserveFFmpegDuration(time.Since(ffmpegStart))
+	if err != nil && ctx.Err() == nil && errors.Is(ffmpegCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s: %w", ErrConversionTimeout, vc.options.ConversionTimeout, err)
+		vc.keepFFmpegLog(task, workDir, ffmpegLog, err)
+		vc.logError(*task, "FFmpeg conversion timed out", err)
+		return result, withStage(StageFFmpeg, err)
+	}
+	if err != nil {
+		vc.keepFFmpegLog(task, workDir, ffmpegLog, err)
+		vc.logError(*task, "Failed to convert video", err)
+		return result, withStage(StageFFmpeg, err)
+	}
+	if !vc.options.KeepFFmpegLog {
+		if err := os.Remove(ffmpegLog); err != nil {
+			task.log().Warn("Failed to remove ffmpeg log", slog.String("error", err.Error()))
+		}
+	}
+	task.log().Info("Video converted", slog.String("path", task.Path), slog.String("format", string(outputFormat)))
+	vc.options.Hooks.afterConvert(*task, outputDirs)
+	// sidecars are the files written next to the output directories, which
+	// the Uploader ships along with them.
+	var sidecars []string
+	if vc.options.GenerateThumbnail {
+		thumbnail, err := vc.generateThumbnail(ctx, mergedFile, workDir, mediaInfo.Duration)
+		if err != nil {
+			vc.logError(*task, "Failed to generate thumbnail", err)
+		} else if result.Thumbnail, err = vc.publishSidecar(task, workDir, thumbnail); err != nil {
+			vc.logError(*task, "Failed to upload thumbnail", err)
+		} else {
+			sidecars = append(sidecars, thumbnail)
+		}
+	}
+	if metadata, err := vc.writeMetadata(task, workDir, mediaInfo); err != nil {
+		vc.logError(*task, "Failed to write metadata", err)
+	} else if result.Metadata, err = vc.publishSidecar(task, workDir, metadata); err != nil {
+		vc.logError(*task, "Failed to upload metadata", err)
+	} else {
+		sidecars = append(sidecars, metadata)
+	}
+	if subtitles != "" && vc.options.SubtitleMode == SubtitleSoft {
+		vtt, err := vc.convertSubtitles(ctx, subtitles, workDir)
+		if err != nil {
+			vc.logError(*task, "Failed to convert subtitles", err)
+		} else {
+			// The track is still listed in the confirmation when the
+			// manifests cannot list it.
+			if err := addSubtitleTracks(workDir, formats, output.manifest, vtt, mediaInfo.Duration, mediaInfo.BitRate); err != nil {
+				vc.logError(*task, "Failed to list subtitles in the manifests", err)
+			}
+			if result.Subtitles, err = vc.publishSidecar(task, workDir, vtt); err != nil {
+				vc.logError(*task, "Failed to upload subtitles", err)
+			} else {
+				sidecars = append(sidecars, vtt)
+			}
+		}
+	}
+	if vc.options.SpriteInterval > 0 {
+		sheets, vtt, err := vc.generateSprites(ctx, mergedFile, workDir, mediaInfo.Duration)
+		if err != nil {
+			vc.logError(*task, "Failed to generate sprites", err)
+		} else if err := vc.publishSprites(task, workDir, sheets, vtt, &result); err != nil {
+			vc.logError(*task, "Failed to upload sprites", err)
+		} else {
+			sidecars = append(sidecars, filepath.Join(workDir, spriteDir))
+		}
+	}
+	err = os.Remove(mergedFile)
+	if err != nil {
+		vc.logError(*task, "Failed to remove merged file", err)
+		return result, withStage(StageStorage, err)
+	}
+	result.Segments, result.OutputBytes, err = outputStats(outputDirs)
+	if err != nil {
+		vc.logError(*task, "Failed to measure output", err)
+		return result, withStage(StageStorage, err)
+	}
+	if workDir != outputPath {
+		task.log().Info("Uploading output to storage", slog.String("path", outputPath))
+		err = vc.uploadOutput(workDir, task, outputDirs)
+		if err != nil {
+			vc.logError(*task, "Failed to upload output", err)
+			return result, withStage(StageStorage, err)
+		}
+	}
+	if vc.options.Uploader != nil {
+		task.log().Info("Uploading output to object storage")
+		uploaded := slices.Concat(outputDirs, sidecars)
+		result.Location, err = vc.uploadObjects(ctx, workDir, task, uploaded)
+		if err != nil {
+			vc.logError(*task, "Failed to upload output to object storage", err)
+			return result, withStage(StageStorage, err)
+		}
+		if vc.options.RemoveAfterUpload && workDir == outputPath {
+			for _, path := range uploaded {
+				if err := os.RemoveAll(path); err != nil {
+					vc.logError(*task, "Failed to remove uploaded output", err)
+				}
+			}
+		}
+	}
+	resultCtx, cancelResult := vc.dbContext(ctx)
+	defer cancelResult()
+	err = RecordResult(resultCtx, vc.db, ConversionResult{
+		VideoID:     task.VideoID,
+		Duration:    mediaInfo.Duration,
+		Width:       mediaInfo.Width,
+		Height:      mediaInfo.Height,
+		VideoCodec:  mediaInfo.VideoCodec,
+		Segments:    result.Segments,
+		OutputBytes: result.OutputBytes,
+		Task:        *task,
+	})
+	if err != nil {
+		vc.logError(*task, "Failed to record conversion result", err)
+	}
+	return result, nil
+}
+
+func (vc *VideoConverter) outputFormat(task VideoTask) OutputFormat {
+	if task.OutputFormat != "" {
+		return task.OutputFormat
+	}
+	return vc.options.OutputFormat
+}
+
+func (vc *VideoConverter) outputDirs(taskPath string, outputFormat OutputFormat) ([]string, error) {
+	formats, err := outputFormat.formats()
+	if err != nil {
+		return nil, err
+	}
+	dirs := make([]string, 0, len(formats))
+	for _, format := range formats {
+		dirs = append(dirs, formatDir(taskPath, format))
+	}
+	return dirs, nil
+}
+
+// keepFFmpegLog uploads the ffmpeg log of a failed run next to the output
+// when the conversion ran outside of storage, since workDir is discarded, and
+// points the FFmpegError in err at the uploaded copy.
+func (vc *VideoConverter) keepFFmpegLog(task *VideoTask, workDir, logFile string, err error) {
+	outputPath := vc.outputPath(task)
+	if workDir == outputPath {
+		return
+	}
+	// A failed rendition encode has its own log.
+	var ffmpegErr *FFmpegError
+	if errors.As(err, &ffmpegErr) && ffmpegErr.LogFile != "" {
+		logFile = ffmpegErr.LogFile
+	}
+	kept := filepath.Join(outputPath, ffmpegLogFile)
+	if uploadErr := vc.uploadFile(logFile, kept); uploadErr != nil {
+		task.log().Warn("Failed to keep ffmpeg log", slog.String("error", uploadErr.Error()))
+		return
+	}
+	if ffmpegErr != nil {
+		ffmpegErr.LogFile = kept
+	}
+}
+
+// removePartialOutput removes what a failed run left behind, except a merged
+// file that the next attempt can resume.
+func (vc *VideoConverter) removePartialOutput(task VideoTask, mergedFile string, outputDirs ...string) {
+	if _, err := os.Stat(mergedFile + mergeStateSuffix); err == nil {
+		task.log().Info("Keeping interrupted merge to resume it", slog.String("path", mergedFile))
+	} else if err := os.Remove(mergedFile); err != nil && !os.IsNotExist(err) {
+		task.log().Error("Failed to remove partial merged file", slog.String("path", mergedFile), slog.String("error", err.Error()))
+	}
+	for _, dir := range outputDirs {
+		if err := os.RemoveAll(dir); err != nil {
+			task.log().Error("Failed to remove partial output", slog.String("path", dir), slog.String("error", err.Error()))
+		}
+	}
+}
+
+func (vc *VideoConverter) logError(task VideoTask, message string, err error) {
+	record := ErrorRecord{
+		VideoID:       task.VideoID,
+		TraceID:       task.TraceID,
+		CorrelationID: task.CorrelationID,
+		Error:         message,
+		Details:       err.Error(),
+		Time:          time.Now(),
+	}
+	var ffmpegErr *FFmpegError
+	if errors.As(err, &ffmpegErr) {
+		record.ExitCode = &ffmpegErr.ExitCode
+		record.FFmpegTail = ffmpegErr.Output
+		record.FFmpegLog = ffmpegErr.LogFile
+	}
+	serializedError, _ := json.Marshal(record)
+	task.log().Error("Processing error", slog.String("error_details", string(serializedError)))
+
+	// Logged directly: going through logError again could loop while the
+	// database is down.
+	ctx, cancel := vc.dbContext(context.Background())
+	defer cancel()
+	if err := RegisterError(ctx, vc.db, record); err != nil {
+		task.log().Error("Failed to register error", slog.String("error", err.Error()), slog.String("error_details", string(serializedError)))
+	}
+}
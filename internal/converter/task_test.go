@@ -0,0 +1,100 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProcessVideoCreatesAccessibleOutputDir(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk")
+
+	task := &VideoTask{VideoID: 1, Path: dir}
+	if _, err := vc.processVideo(context.Background(), task); err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(dir, dashDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() {
+		t.Fatalf("%s is not a directory", dashDir)
+	}
+	if perm := info.Mode().Perm(); perm&0o700 != 0o700 {
+		t.Errorf("output dir mode = %v, want rwx for the owner", perm)
+	}
+}
+
+func TestProcessVideoReplacesPreviousOutput(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+	stale := filepath.Join(dir, dashDir, "chunk-stream0-00042.m4s")
+	if err := os.MkdirAll(filepath.Dir(stale), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir}); err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("segment of the previous conversion was kept: %v", err)
+	}
+	calls := vc.options.Runner.(*stubRunner).ffmpegCalls()
+	if len(calls) != 1 || calls[0][0] != "-y" {
+		t.Errorf("ffmpeg calls = %q, want the conversion to overwrite its output", calls)
+	}
+}
+
+func TestInsufficientDiskSpaceIsAStorageFailure(t *testing.T) {
+	vc, _ := newTestConverter(t, ConversionOptions{DiskSpaceMultiplier: 1e18})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	_, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir})
+	if !errors.Is(err, ErrInsufficientDiskSpace) || !errors.Is(err, ErrStorage) || errors.Is(err, ErrMerge) {
+		t.Errorf("processVideo error = %v, want a storage failure", err)
+	}
+	if calls := vc.options.Runner.(*stubRunner).ffmpegCalls(); len(calls) != 0 {
+		t.Errorf("ffmpeg ran %d times without disk space", len(calls))
+	}
+}
+
+// converterFunc adapts a function to Converter.
+type converterFunc func(ctx context.Context, task *VideoTask) (*Result, error)
+
+func (f converterFunc) Convert(ctx context.Context, task *VideoTask) (*Result, error) {
+	return f(ctx, task)
+}
+
+func TestConverterWithoutResultFails(t *testing.T) {
+	metrics := &recordingMetrics{}
+	vc, fake := newTestConverter(t, ConversionOptions{
+		Converter: converterFunc(func(context.Context, *VideoTask) (*Result, error) { return nil, nil }),
+		Metrics:   metrics,
+	})
+	d, ack := newDelivery(t, VideoTask{VideoID: 1, Path: t.TempDir()})
+
+	handle(context.Background(), vc, d)
+
+	if outcome := ack.outcome(); outcome != "ack" {
+		t.Errorf("delivery was %s, want ack", outcome)
+	}
+	if metrics.succeeded != 0 || len(metrics.failed) != 1 {
+		t.Errorf("recorded %d succeeded and failed %v, want one failure", metrics.succeeded, metrics.failed)
+	}
+	if len(fake.outboxRows()) != 0 {
+		t.Errorf("outbox = %+v, want no confirmation", fake.outboxRows())
+	}
+	published := vc.rabbitmqClient.(*fakeBroker).messages()
+	if len(published) != 1 || published[0].exchange != "conversion" {
+		t.Errorf("published %+v, want the task retried", published)
+	}
+}
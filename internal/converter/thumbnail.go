@@ -0,0 +1,35 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultThumbnailAt = time.Second
+	thumbnailFile      = "thumbnail.jpg"
+)
+
+// generateThumbnail extracts a single frame of inputFile into workDir. When
+// the video is shorter than ThumbnailAt the first frame is used instead.
+func (vc *VideoConverter) generateThumbnail(ctx context.Context, inputFile, workDir string, duration time.Duration) (string, error) {
+	at := vc.options.ThumbnailAt
+	if at >= duration {
+		at = 0
+	}
+	thumbnail := filepath.Join(workDir, thumbnailFile)
+	output, err := vc.runFFmpegCommand(ctx,
+		"-ss", formatSeconds(at),
+		"-i", inputFile,
+		"-frames:v", "1",
+		"-q:v", "2",
+		"-y",
+		thumbnail,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate thumbnail: %v, output: %s", err, output)
+	}
+	return thumbnail, nil
+}
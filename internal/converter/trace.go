@@ -0,0 +1,26 @@
+package converter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/streadway/amqp"
+)
+
+const traceIDHeader = "x-trace-id"
+
+func traceID(d amqp.Delivery, task VideoTask) string {
+	if id, ok := d.Headers[traceIDHeader].(string); ok && id != "" {
+		return id
+	}
+	if task.TraceID != "" {
+		return task.TraceID
+	}
+	return newTraceID()
+}
+
+func newTraceID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,54 @@
+package converter
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "imersaofc/internal/converter"
+
+var propagator = propagation.TraceContext{}
+
+// amqpCarrier reads and writes the W3C trace context in AMQP headers.
+type amqpCarrier amqp.Table
+
+func (c amqpCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c amqpCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (vc *VideoConverter) tracer() trace.Tracer {
+	return vc.options.TracerProvider.Tracer(tracerName)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceHeaders returns the trace context of ctx, to be carried by the
+// confirmation so downstream consumers continue the trace.
+func traceHeaders(ctx context.Context) map[string]string {
+	headers := propagation.MapCarrier{}
+	propagator.Inject(ctx, headers)
+	return headers
+}
@@ -0,0 +1,157 @@
+package converter
+
+import (
+	"context"
+	"fmt"
+	"imersaofc/internal/storage"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+func (vc *VideoConverter) localStorage() bool {
+	_, ok := vc.options.Storage.(*storage.Local)
+	return ok
+}
+
+// outputPath is where the converted output of task ends up in storage:
+// OutputBaseDir/<video id> when set, next to the chunks otherwise.
+func (vc *VideoConverter) outputPath(task *VideoTask) string {
+	if vc.options.OutputBaseDir == "" {
+		return task.Path
+	}
+	return filepath.Join(vc.options.OutputBaseDir, strconv.Itoa(task.VideoID))
+}
+
+// workDir returns the local directory ffmpeg works in. Local storage converts
+// directly into the output path; any other storage converts in a temporary
+// directory named after the video, so a retry finds the merge it interrupted.
+func (vc *VideoConverter) workDir(task *VideoTask) (string, error) {
+	if vc.localStorage() {
+		dir := vc.outputPath(task)
+		return dir, os.MkdirAll(dir, 0755)
+	}
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("video-%d", task.VideoID))
+	return dir, os.MkdirAll(dir, 0o700)
+}
+
+// uploadOutput copies every file under the given local output directories to
+// storage, keeping their path relative to workDir under the output path.
+func (vc *VideoConverter) uploadOutput(workDir string, task *VideoTask, outputDirs []string) error {
+	for _, dir := range outputDirs {
+		err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(workDir, path)
+			if err != nil {
+				return err
+			}
+			return vc.uploadFile(path, filepath.Join(vc.outputPath(task), rel))
+		})
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+func (vc *VideoConverter) uploadFile(localPath, remotePath string) error {
+	input, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output, err := vc.options.Storage.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(output, input); err != nil {
+		output.Close()
+		return err
+	}
+	return output.Close()
+}
+
+// publishSidecar returns the path of a file written into workDir next to the
+// output directories, relative to the output, uploading the file to storage
+// first when the conversion ran outside of it.
+func (vc *VideoConverter) publishSidecar(task *VideoTask, workDir, file string) (string, error) {
+	rel, err := filepath.Rel(workDir, file)
+	if err != nil {
+		return "", err
+	}
+	if workDir != vc.outputPath(task) {
+		if err := vc.uploadFile(file, filepath.Join(vc.outputPath(task), rel)); err != nil {
+			return "", err
+		}
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Uploader ships the converted output to object storage once the conversion
+// succeeded.
+type Uploader interface {
+	Upload(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Location returns the URI downstream systems use to reach key.
+	Location(key string) string
+}
+
+var contentTypes = map[string]string{
+	".mpd":  "application/dash+xml",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4s":  "video/iso.segment",
+	".ts":   "video/mp2t",
+	".mp4":  "video/mp4",
+	".vtt":  "text/vtt",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+}
+
+func contentType(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if t, ok := contentTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// uploadObjects uploads the given files and every file under the given
+// directories with the Uploader, keeping their path relative to workDir under
+// the video prefix, and returns the location of that prefix.
+func (vc *VideoConverter) uploadObjects(ctx context.Context, workDir string, task *VideoTask, paths []string) (string, error) {
+	prefix := path.Join(vc.options.UploadPrefix, strconv.Itoa(task.VideoID))
+	for _, dir := range paths {
+		err := filepath.WalkDir(dir, func(file string, entry os.DirEntry, err error) error {
+			if err != nil || entry.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(workDir, file)
+			if err != nil {
+				return err
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			input, err := os.Open(file)
+			if err != nil {
+				return err
+			}
+			defer input.Close()
+			return vc.options.Uploader.Upload(ctx, path.Join(prefix, filepath.ToSlash(rel)), input, info.Size(), contentType(file))
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to upload %s: %v", dir, err)
+		}
+	}
+	return vc.options.Uploader.Location(prefix), nil
+}
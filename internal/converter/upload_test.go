@@ -0,0 +1,105 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeUploader records the keys it was given, failing every upload with err
+// when set.
+type fakeUploader struct {
+	mu   sync.Mutex
+	keys []string
+	err  error
+}
+
+func (u *fakeUploader) Upload(_ context.Context, key string, body io.Reader, _ int64, _ string) error {
+	if u.err != nil {
+		return u.err
+	}
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.keys = append(u.keys, key)
+	return nil
+}
+
+func (u *fakeUploader) Location(key string) string {
+	return "s3://bucket/" + key
+}
+
+func TestUploaderShipsSidecars(t *testing.T) {
+	runner := &stubRunner{}
+	runner.run = func(_ context.Context, name string, args ...string) ([]byte, error) {
+		if name == defaultFFprobePath {
+			return []byte(ffprobeJSON), nil
+		}
+		// The thumbnail command ends with the image it writes.
+		if output := args[len(args)-1]; filepath.Base(output) == thumbnailFile {
+			return nil, os.WriteFile(output, []byte("jpeg"), 0o644)
+		}
+		return nil, nil
+	}
+	uploader := &fakeUploader{}
+	vc, _ := newTestConverter(t, ConversionOptions{
+		Runner:            runner,
+		GenerateThumbnail: true,
+		Uploader:          uploader,
+		UploadPrefix:      "videos",
+		RemoveAfterUpload: true,
+	})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk")
+
+	result, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir})
+	if err != nil {
+		t.Fatalf("processVideo: %v", err)
+	}
+	if result.Location != "s3://bucket/videos/1" {
+		t.Errorf("Location = %q, want the uploaded prefix", result.Location)
+	}
+	if result.Thumbnail != thumbnailFile || result.Metadata != metadataFile {
+		t.Errorf("Thumbnail, Metadata = %q, %q, want them relative to Location", result.Thumbnail, result.Metadata)
+	}
+	for _, key := range []string{"videos/1/" + thumbnailFile, "videos/1/" + metadataFile} {
+		if !slices.Contains(uploader.keys, key) {
+			t.Errorf("%s was not uploaded, got %q", key, uploader.keys)
+		}
+	}
+	for _, file := range []string{thumbnailFile, metadataFile} {
+		if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+			t.Errorf("%s was kept after the upload: %v", file, err)
+		}
+	}
+}
+
+func TestFailedUploadIsAStorageFailure(t *testing.T) {
+	metrics := &recordingMetrics{}
+	vc, _ := newTestConverter(t, ConversionOptions{
+		Uploader:     &fakeUploader{err: errors.New("bucket unavailable")},
+		Metrics:      metrics,
+		RetryBackoff: time.Millisecond,
+	})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	_, err := vc.processVideo(context.Background(), &VideoTask{VideoID: 1, Path: dir})
+	if !errors.Is(err, ErrStorage) || errors.Is(err, ErrFFmpeg) {
+		t.Fatalf("processVideo error = %v, want a storage failure", err)
+	}
+
+	d, _ := newDelivery(t, VideoTask{VideoID: 2, Path: dir})
+	handle(context.Background(), vc, d)
+	if !slices.Equal(metrics.failed, []Stage{StageStorage}) {
+		t.Errorf("failed stages = %v, want [%s]", metrics.failed, StageStorage)
+	}
+}
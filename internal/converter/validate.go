@@ -0,0 +1,112 @@
+package converter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// ValidationError lists every problem ValidateTask found in a task.
+type ValidationError struct {
+	VideoID  int
+	Problems []error
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Error()
+	}
+	return fmt.Sprintf("task %d is invalid: %s", e.VideoID, strings.Join(problems, "; "))
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.Problems
+}
+
+// ValidateTask checks that a task could be converted, without merging or
+// running ffmpeg: the chunks exist, are numbered without gaps, and the output
+// directory is writable. It does not create the output directory.
+func (vc *VideoConverter) ValidateTask(task *VideoTask) error {
+	var problems []error
+	if err := vc.resolvePath(task); err != nil {
+		problems = append(problems, err)
+		return &ValidationError{VideoID: task.VideoID, Problems: problems}
+	}
+
+	if _, err := vc.outputFormat(*task).formats(); err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, vc.validateChunks(task)...)
+
+	if err := vc.checkOutputWritable(task); err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{VideoID: task.VideoID, Problems: problems}
+	}
+	return nil
+}
+
+func (vc *VideoConverter) validateChunks(task *VideoTask) []error {
+	files, err := vc.listChunks(task.Path)
+	if err != nil {
+		return []error{fmt.Errorf("failed to find chunks: %v", err)}
+	}
+	if len(files) == 0 {
+		return []error{vc.noChunksError(task.Path)}
+	}
+
+	var problems []error
+	if task.ExpectedChunks > 0 && len(files) != task.ExpectedChunks {
+		problems = append(problems, &MergeMismatchError{Field: "chunk count", Expected: int64(task.ExpectedChunks), Actual: int64(len(files))})
+	}
+	var indices []int
+	for _, file := range files {
+		index, err := vc.extractNumber(file)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return append(problems, sequenceErrors(indices, vc.options.FirstChunkIndex)...)
+}
+
+// checkOutputWritable checks that the conversion could write its output
+// without creating anything: the nearest existing ancestor of the directory
+// workDir would create must be a writable directory.
+func (vc *VideoConverter) checkOutputWritable(task *VideoTask) error {
+	dir := os.TempDir()
+	if vc.localStorage() {
+		dir = vc.outputPath(task)
+	}
+	for existing := dir; ; existing = filepath.Dir(existing) {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("output directory %s cannot be created: %s is not a directory", dir, existing)
+			}
+			return checkWritable(existing)
+		}
+		// ENOTDIR means an ancestor is a file, reported once it is reached.
+		if !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) || filepath.Dir(existing) == existing {
+			return fmt.Errorf("output directory %s cannot be created: %v", dir, err)
+		}
+	}
+}
+
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,66 @@
+package converter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateTaskDoesNotCreateOutputDir(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "outputs")
+	vc, _ := newTestConverter(t, ConversionOptions{OutputBaseDir: output})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_1.chunk")
+
+	if err := vc.ValidateTask(&VideoTask{VideoID: 1, Path: dir}); err != nil {
+		t.Fatalf("ValidateTask: %v", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("ValidateTask created %s: %v", output, err)
+	}
+}
+
+func TestValidateTaskListsEveryProblem(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(base, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vc, _ := newTestConverter(t, ConversionOptions{OutputBaseDir: base})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk", "chunk_2.chunk", "stray.chunk")
+
+	err := vc.ValidateTask(&VideoTask{VideoID: 1, Path: dir})
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("ValidateTask error = %v, want a ValidationError", err)
+	}
+	for _, problem := range []string{"stray.chunk has no numeric index", "missing chunk 1", "is not a directory"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("ValidateTask error %q does not report %q", err, problem)
+		}
+	}
+	if !errors.Is(err, ErrInvalidInput) {
+		t.Error("ValidateTask error does not match ErrInvalidInput")
+	}
+}
+
+func TestValidateTaskReadOnlyOutput(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	parent := t.TempDir()
+	if err := os.Chmod(parent, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(parent, 0o755) })
+	vc, _ := newTestConverter(t, ConversionOptions{OutputBaseDir: filepath.Join(parent, "outputs")})
+	dir := t.TempDir()
+	writeChunks(t, dir, "chunk_0.chunk")
+
+	err := vc.ValidateTask(&VideoTask{VideoID: 1, Path: dir})
+	if err == nil || !strings.Contains(err.Error(), "is not writable") {
+		t.Errorf("ValidateTask error = %v, want the output reported as not writable", err)
+	}
+}
@@ -0,0 +1,68 @@
+package converter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+	webhookBackoff  = time.Second
+)
+
+type WebhookPayload struct {
+	VideoID  int        `json:"video_id"`
+	Location string     `json:"location"`
+	Media    *MediaInfo `json:"media"`
+}
+
+// notifyWebhook POSTs the payload to CompletionWebhook. The AMQP confirmation
+// is the source of truth, so failures are only logged.
+func (vc *VideoConverter) notifyWebhook(ctx context.Context, task VideoTask, payload WebhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: webhookTimeout}
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err = postWebhook(ctx, client, vc.options.CompletionWebhook, body)
+		if err == nil {
+			task.log().Info("Completion webhook delivered")
+			return
+		}
+		if attempt == webhookAttempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+	}
+	task.log().Error("Failed to deliver completion webhook", slog.Int("attempts", webhookAttempts), slog.String("error", err.Error()))
+}
+
+func postWebhook(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
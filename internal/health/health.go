@@ -0,0 +1,74 @@
+package health
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"imersaofc/internal/rabbitmq"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const pingTimeout = 2 * time.Second
+
+var (
+	ErrShuttingDown = errors.New("shutting down")
+	ErrBrokerClosed = errors.New("rabbitmq connection closed")
+)
+
+// Checker reports whether the process can take work: the database answers a
+// ping, the broker connection is open and no shutdown is in progress.
+type Checker struct {
+	db             *sql.DB
+	rabbitmqClient *rabbitmq.RabbitClient
+	shuttingDown   atomic.Bool
+}
+
+func NewChecker(db *sql.DB, rabbitmqClient *rabbitmq.RabbitClient) *Checker {
+	return &Checker{db: db, rabbitmqClient: rabbitmqClient}
+}
+
+// ShuttingDown makes readiness fail from now on, so the orchestrator stops
+// routing traffic while in-flight tasks drain.
+func (c *Checker) ShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+func (c *Checker) Ready(ctx context.Context) error {
+	if c.shuttingDown.Load() {
+		return ErrShuttingDown
+	}
+	if !c.rabbitmqClient.IsOpen() {
+		return ErrBrokerClosed
+	}
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if err := c.db.PingContext(ctx); err != nil {
+		return errors.New("database unavailable: " + err.Error())
+	}
+	return nil
+}
+
+// Healthz only reports that the process is alive.
+func (c *Checker) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func (c *Checker) Readyz(w http.ResponseWriter, r *http.Request) {
+	if err := c.Ready(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// Handler serves /healthz and /readyz.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.Healthz)
+	mux.HandleFunc("/readyz", c.Readyz)
+	return mux
+}
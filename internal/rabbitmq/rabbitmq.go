@@ -1,121 +1,364 @@
-package rabbitmq
-
-import (
-	"fmt"
-
-	"github.com/streadway/amqp"
-)
-
-type RabbitClient struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
-	url     string
-}
-
-func newConnection(url string) (*amqp.Connection, *amqp.Channel, error) {
-	conn, err := amqp.Dial(url)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
-	}
-
-	channel, err := conn.Channel()
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to open a channel: %v", err)
-	}
-	return conn, channel, nil
-}
-
-func NewRabbitClient(connectionURL string) (*RabbitClient, error) {
-	conn, channel, err := newConnection(connectionURL)
-	if err != nil {
-		return nil, err
-	}
-	return &RabbitClient{
-		conn:    conn,
-		channel: channel,
-		url:     connectionURL,
-	}, nil
-}
-
-func (client *RabbitClient) ConsumeMessages(exchange, routingKey, queueName string) (<-chan amqp.Delivery, error) {
-	err := client.channel.ExchangeDeclare(
-		exchange,
-		"direct",
-		true,
-		true,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to declare exchange: %v", err)
-	}
-
-	queue, err := client.channel.QueueDeclare(queueName, true, true, true, false, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to declare queue: %v", err)
-	}
-
-	err = client.channel.QueueBind(queue.Name, routingKey, exchange, false, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to bind queue to exchange: %v", err)
-	}
-
-	msgs, err := client.channel.Consume(
-		queueName,
-		"goapp",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to consume messages: %v", err)
-	}
-	return msgs, nil
-}
-
-func (client *RabbitClient) PublishMessage(exchange, routingKey, queueName string, message []byte) error {
-	err := client.channel.ExchangeDeclare(
-		exchange,
-		"direct",
-		true,
-		true,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare exchange: %v", err)
-	}
-	queue, err := client.channel.QueueDeclare(queueName, true, true, true, false, nil)
-	if err != nil {
-		return fmt.Errorf("failed to declare queue: %v", err)
-	}
-
-	err = client.channel.QueueBind(queue.Name, routingKey, exchange, false, nil)
-	if err != nil {
-		return fmt.Errorf("failed to bind queue to exchange: %v", err)
-	}
-
-	err = client.channel.Publish(
-		exchange,
-		routingKey,
-		false,
-		false,
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        message,
-		},
-	)
-	if err != nil {
-		return fmt.Errorf("failed to publish message: %v", err)
-	}
-	return nil
-}
-
-func (client *RabbitClient) Close() {
-	client.channel.Close()
-	client.conn.Close()
-}
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultMaxBackoff     = 30 * time.Second
+	defaultPrefetch       = 2
+	defaultConfirmTimeout = 5 * time.Second
+	defaultPublishRetry   = 10 * time.Second
+	consumerTag           = "goapp"
+)
+
+type ClientOptions struct {
+	// MaxBackoff caps the delay between reconnection attempts.
+	MaxBackoff time.Duration
+	// Prefetch limits how many unacked deliveries the broker hands to this
+	// consumer. A value of 1 processes strictly one task at a time, which is
+	// what most CPU-bound ffmpeg workloads want. Defaults to 2.
+	Prefetch int
+	// ConfirmTimeout bounds how long a publish waits for the broker to
+	// confirm it.
+	ConfirmTimeout time.Duration
+	// PublishRetry bounds how long a publish that failed on a closed channel
+	// waits for a reconnection to try again. Defaults to 10s.
+	PublishRetry time.Duration
+	// OnReconnect, when set, is called after every successful reconnection.
+	OnReconnect func()
+}
+
+type RabbitClient struct {
+	mu          sync.RWMutex
+	conn        *amqp.Connection
+	channel     *amqp.Channel
+	confirms    chan amqp.Confirmation
+	publishMu   sync.Mutex
+	publishTag  uint64
+	url         string
+	options     ClientOptions
+	reconnected chan struct{}
+	done        chan struct{}
+	closeOnce   sync.Once
+	stopped     chan struct{}
+	stopOnce    sync.Once
+}
+
+func newConnection(url string) (*amqp.Connection, *amqp.Channel, chan amqp.Confirmation, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %v", err)
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to open a channel: %v", err)
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 8))
+	return conn, channel, confirms, nil
+}
+
+func NewRabbitClient(connectionURL string, options ClientOptions) (*RabbitClient, error) {
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = defaultMaxBackoff
+	}
+	if options.Prefetch <= 0 {
+		options.Prefetch = defaultPrefetch
+	}
+	if options.ConfirmTimeout <= 0 {
+		options.ConfirmTimeout = defaultConfirmTimeout
+	}
+	if options.PublishRetry <= 0 {
+		options.PublishRetry = defaultPublishRetry
+	}
+	conn, channel, confirms, err := newConnection(connectionURL)
+	if err != nil {
+		return nil, err
+	}
+	client := &RabbitClient{
+		conn:        conn,
+		channel:     channel,
+		confirms:    confirms,
+		url:         connectionURL,
+		options:     options,
+		reconnected: make(chan struct{}),
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go client.watch(conn, channel)
+	return client, nil
+}
+
+func (client *RabbitClient) currentChannel() *amqp.Channel {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.channel
+}
+
+func (client *RabbitClient) declareAndBind(channel *amqp.Channel, exchange, routingKey, queueName string) error {
+	err := channel.ExchangeDeclare(
+		exchange,
+		"direct",
+		true,
+		true,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare exchange: %w", err)
+	}
+
+	queue, err := channel.QueueDeclare(queueName, true, true, true, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare queue: %w", err)
+	}
+
+	err = channel.QueueBind(queue.Name, routingKey, exchange, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to bind queue to exchange: %w", err)
+	}
+	return nil
+}
+
+func (client *RabbitClient) consume(exchange, routingKey, queueName string) (<-chan amqp.Delivery, error) {
+	channel := client.currentChannel()
+	if err := client.declareAndBind(channel, exchange, routingKey, queueName); err != nil {
+		return nil, err
+	}
+
+	client.mu.RLock()
+	prefetch := client.options.Prefetch
+	client.mu.RUnlock()
+	err := channel.Qos(prefetch, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set prefetch: %v", err)
+	}
+
+	msgs, err := channel.Consume(
+		queueName,
+		consumerTag,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume messages: %v", err)
+	}
+	return msgs, nil
+}
+
+// SetPrefetch changes the prefetch applied by subsequent ConsumeMessages calls
+// and by resubscriptions after a reconnect.
+func (client *RabbitClient) SetPrefetch(prefetch int) {
+	if prefetch <= 0 {
+		prefetch = defaultPrefetch
+	}
+	client.mu.Lock()
+	client.options.Prefetch = prefetch
+	client.mu.Unlock()
+}
+
+// ConsumeMessages returns a delivery channel that survives reconnections: when
+// the broker connection drops, the queue is re-declared and consumption resumes
+// on the new channel. The returned channel is closed once the client is closed.
+func (client *RabbitClient) ConsumeMessages(exchange, routingKey, queueName string) (<-chan amqp.Delivery, error) {
+	msgs, err := client.consume(exchange, routingKey, queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for {
+			for d := range msgs {
+				select {
+				case out <- d:
+				case <-client.done:
+					return
+				}
+			}
+			select {
+			case <-client.stopped:
+				return
+			default:
+			}
+			msgs, err = client.resubscribe(exchange, routingKey, queueName)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (client *RabbitClient) PublishMessage(exchange, routingKey, queueName string, message []byte) error {
+	return client.PublishMessageWithHeaders(exchange, routingKey, queueName, message, nil)
+}
+
+func (client *RabbitClient) PublishMessageWithHeaders(exchange, routingKey, queueName string, message []byte, headers amqp.Table) error {
+	return client.PublishToQueue(exchange, routingKey, queueName, amqp.Publishing{
+		ContentType: "application/json",
+		Headers:     headers,
+		Body:        message,
+	})
+}
+
+// PublishToQueue declares and binds queueName before publishing msg, so the
+// message is not lost when nothing consumed from the queue yet.
+func (client *RabbitClient) PublishToQueue(exchange, routingKey, queueName string, msg amqp.Publishing) error {
+	return client.retryOnClosed(func() error {
+		if err := client.declareAndBind(client.currentChannel(), exchange, routingKey, queueName); err != nil {
+			return err
+		}
+		return client.publish(exchange, routingKey, msg)
+	})
+}
+
+// PublishDelayed publishes msg to exchange with routingKey once delay
+// elapsed. The message waits in a queue without consumers whose TTL is delay
+// and whose dead-letter target is exchange, one queue per delay so a long
+// delay never holds back a shorter one. An unused delay queue expires.
+func (client *RabbitClient) PublishDelayed(exchange, routingKey string, delay time.Duration, msg amqp.Publishing) error {
+	queueName := fmt.Sprintf("%s.%s.delay.%d", exchange, routingKey, delay.Milliseconds())
+	args := amqp.Table{
+		"x-message-ttl":             delay.Milliseconds(),
+		"x-dead-letter-exchange":    exchange,
+		"x-dead-letter-routing-key": routingKey,
+		"x-expires":                 (2*delay + time.Minute).Milliseconds(),
+	}
+	return client.retryOnClosed(func() error {
+		_, err := client.currentChannel().QueueDeclare(queueName, true, false, false, false, args)
+		if err != nil {
+			return fmt.Errorf("failed to declare delay queue: %w", err)
+		}
+		return client.publish("", queueName, msg)
+	})
+}
+
+// Publish sends msg and waits for the broker to confirm it. Publishes are
+// serialized so each confirmation can be matched to its message. A publish
+// that fails because the channel closed is retried once the client
+// reconnected, for up to PublishRetry.
+func (client *RabbitClient) Publish(exchange, routingKey string, msg amqp.Publishing) error {
+	return client.retryOnClosed(func() error {
+		return client.publish(exchange, routingKey, msg)
+	})
+}
+
+var errConfirmsClosed = errors.New("channel closed before the publish was confirmed")
+
+func (client *RabbitClient) retryOnClosed(fn func() error) error {
+	deadline := time.After(client.options.PublishRetry)
+	for {
+		reconnected := client.Reconnected()
+		err := fn()
+		if err == nil || !isClosedError(err) {
+			return err
+		}
+		select {
+		case <-reconnected:
+			slog.Info("Retrying publish after reconnection")
+		case <-deadline:
+			return err
+		case <-client.done:
+			return ErrClientClosed
+		}
+	}
+}
+
+func isClosedError(err error) bool {
+	return errors.Is(err, errConfirmsClosed) || errors.Is(err, amqp.ErrClosed)
+}
+
+func (client *RabbitClient) publish(exchange, routingKey string, msg amqp.Publishing) error {
+	client.publishMu.Lock()
+	defer client.publishMu.Unlock()
+
+	client.mu.Lock()
+	channel, confirms := client.channel, client.confirms
+	client.publishTag++
+	tag := client.publishTag
+	client.mu.Unlock()
+
+	err := channel.Publish(
+		exchange,
+		routingKey,
+		false,
+		false,
+		msg,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	timeout := time.After(client.options.ConfirmTimeout)
+	for {
+		select {
+		case confirmation, ok := <-confirms:
+			if !ok {
+				return errConfirmsClosed
+			}
+			if confirmation.DeliveryTag < tag {
+				// Late confirmation of a publish that already timed out.
+				continue
+			}
+			if !confirmation.Ack {
+				return fmt.Errorf("broker rejected message %d", confirmation.DeliveryTag)
+			}
+			return nil
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for publish confirmation after %s", client.options.ConfirmTimeout)
+		}
+	}
+}
+
+// StopConsuming cancels the consumer so the broker stops delivering new
+// messages. Deliveries already received can still be acked, and the channel
+// returned by ConsumeMessages is closed once the broker confirms.
+func (client *RabbitClient) StopConsuming() error {
+	var err error
+	client.stopOnce.Do(func() {
+		close(client.stopped)
+		err = client.currentChannel().Cancel(consumerTag, false)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to cancel consumer: %v", err)
+	}
+	return nil
+}
+
+// Close closes the channel and the connection. Only the first call does
+// anything; a connection that was already lost is not an error.
+func (client *RabbitClient) Close() error {
+	var errs []error
+	client.closeOnce.Do(func() {
+		close(client.done)
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		if err := client.channel.Close(); err != nil && err != amqp.ErrClosed {
+			errs = append(errs, err)
+		}
+		if err := client.conn.Close(); err != nil && err != amqp.ErrClosed {
+			errs = append(errs, err)
+		}
+	})
+	return errors.Join(errs...)
+}
@@ -0,0 +1,110 @@
+package rabbitmq
+
+import (
+	"errors"
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const initialBackoff = 500 * time.Millisecond
+
+var ErrClientClosed = errors.New("rabbitmq client closed")
+
+// watch waits for the given connection or channel to close and reconnects
+// unless the client itself is being closed.
+func (client *RabbitClient) watch(conn *amqp.Connection, channel *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	var reason *amqp.Error
+	select {
+	case reason = <-connClosed:
+	case reason = <-channelClosed:
+	case <-client.done:
+		return
+	}
+	if reason == nil {
+		// Closed gracefully through Close.
+		return
+	}
+
+	slog.Warn("RabbitMQ connection lost, reconnecting", slog.String("reason", reason.Error()))
+	if err := client.Reconnect(); err != nil {
+		slog.Error("RabbitMQ reconnection aborted", slog.String("error", err.Error()))
+	}
+}
+
+// Reconnect replaces the current connection and channel, retrying with
+// exponential backoff and jitter until it succeeds or the client is closed.
+func (client *RabbitClient) Reconnect() error {
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		conn, channel, confirms, err := newConnection(client.url)
+		if err == nil {
+			client.mu.Lock()
+			if client.conn != nil {
+				client.conn.Close()
+			}
+			client.conn = conn
+			client.channel = channel
+			client.confirms = confirms
+			client.publishTag = 0
+			close(client.reconnected)
+			client.reconnected = make(chan struct{})
+			client.mu.Unlock()
+
+			slog.Info("Reconnected to RabbitMQ", slog.Int("attempt", attempt))
+			go client.watch(conn, channel)
+			if client.options.OnReconnect != nil {
+				client.options.OnReconnect()
+			}
+			return nil
+		}
+
+		delay := backoff + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		slog.Warn("RabbitMQ reconnection failed", slog.Int("attempt", attempt), slog.Duration("retry_in", delay), slog.String("error", err.Error()))
+		select {
+		case <-time.After(delay):
+		case <-client.done:
+			return ErrClientClosed
+		}
+		backoff = min(backoff*2, client.options.MaxBackoff)
+	}
+}
+
+// IsOpen reports whether the client currently holds a live connection. It is
+// false while reconnecting.
+func (client *RabbitClient) IsOpen() bool {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.conn != nil && !client.conn.IsClosed()
+}
+
+// Reconnected returns a channel that is closed on the next successful
+// reconnection. Call it again afterwards to wait for the following one.
+func (client *RabbitClient) Reconnected() <-chan struct{} {
+	client.mu.RLock()
+	defer client.mu.RUnlock()
+	return client.reconnected
+}
+
+// resubscribe restarts consumption, waiting for reconnections until the
+// consumer can be re-established on a live channel.
+func (client *RabbitClient) resubscribe(exchange, routingKey, queueName string) (<-chan amqp.Delivery, error) {
+	for {
+		reconnected := client.Reconnected()
+		msgs, err := client.consume(exchange, routingKey, queueName)
+		if err == nil {
+			slog.Info("Resubscribed to queue", slog.String("queue", queueName))
+			return msgs, nil
+		}
+		select {
+		case <-reconnected:
+		case <-client.done:
+			return nil, ErrClientClosed
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage abstracts where task chunks are read from and where converted
+// output is written to.
+type Storage interface {
+	List(prefix string) ([]string, error)
+	Open(path string) (io.ReadCloser, error)
+	Create(path string) (io.WriteCloser, error)
+	Remove(path string) error
+	Size(path string) (int64, error)
+}
+
+type Local struct{}
+
+func NewLocal() *Local {
+	return &Local{}
+}
+
+// DirPrefix turns a directory into a prefix that lists its direct entries.
+func DirPrefix(dir string) string {
+	return strings.TrimSuffix(dir, string(filepath.Separator)) + string(filepath.Separator)
+}
+
+func (l *Local) List(prefix string) ([]string, error) {
+	dir := filepath.Dir(prefix)
+	if strings.HasSuffix(prefix, string(filepath.Separator)) {
+		dir = filepath.Clean(prefix)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %v", prefix, err)
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if strings.HasPrefix(path, strings.TrimSuffix(prefix, string(filepath.Separator))) {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+func (l *Local) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (l *Local) Create(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func (l *Local) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (l *Local) Size(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}